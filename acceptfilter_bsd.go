@@ -0,0 +1,35 @@
+// +build dragonfly freebsd netbsd
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// sizeofAcceptFilterArg is the size of struct accept_filter_arg, a 16-byte
+// filter name followed by its argument.
+const sizeofAcceptFilterArg = 256
+
+// setAcceptFilter attaches the "dataready" accept filter to a listening
+// socket for WithDeferAccept, so that Accept only returns connections once
+// data has arrived.
+func setAcceptFilter(fd int) error {
+	var arg [sizeofAcceptFilterArg]byte
+	copy(arg[:], "dataready")
+
+	err := syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTFILTER, string(arg[:]))
+	if err == syscall.ENOENT {
+		return sockoptError("SO_ACCEPTFILTER", fmt.Errorf("%w (accf_data is not loaded)", err))
+	}
+	if err != nil {
+		return sockoptError("SO_ACCEPTFILTER", err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// +build linux
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// addrInUseStates are the TCP states dumped to diagnose EADDRINUSE: all but
+// the request and TIME_WAIT sockets, which never block a bind with
+// SO_REUSEADDR.
+const addrInUseStates = (1<<(tcpBoundInactive+1) - 2) &^ (1<<tcpSynRecv | 1<<tcpTimeWait | 1<<tcpNewSynRecv)
+
+// AddrConflict is a socket that keeps another one from binding to its
+// address.
+type AddrConflict struct {
+	Sibling
+
+	// NoReusePort is set when the socket does not have SO_REUSEPORT set,
+	// so nothing else can join it. For sockets of other processes, it is
+	// inferred: one on the exact same address and device, of the same
+	// user, can only keep a socket with SO_REUSEPORT from binding if it
+	// lacks the option.
+	NoReusePort bool
+
+	// OtherUID is set when the socket belongs to another user. Linux
+	// only groups sockets with SO_REUSEPORT whose owners have the same
+	// effective UID.
+	OtherUID bool
+}
+
+// String describes the conflict, like "nginx (pid 1234) without SO_REUSEPORT".
+func (c AddrConflict) String() string {
+	s := c.owners()
+	if c.NoReusePort {
+		s += " without SO_REUSEPORT"
+	}
+	if c.OtherUID {
+		s += fmt.Sprintf(" owned by uid %d", c.UID)
+	}
+	return s
+}
+
+// AddrInUseError is returned by NewReusablePortListener and
+// NewReusablePortPacketConn when bind fails with EADDRINUSE. It lists the
+// sockets found on the address, as far as sock_diag and /proc show them.
+type AddrInUseError struct {
+	Net       string
+	Addr      string
+	Conflicts []AddrConflict
+	Err       error // syscall.EADDRINUSE
+}
+
+func (e *AddrInUseError) Error() string {
+	s := e.Err.Error()
+	if len(e.Conflicts) == 0 {
+		return s
+	}
+
+	held := make([]string, len(e.Conflicts))
+	for i, c := range e.Conflicts {
+		held[i] = c.String()
+	}
+	return s + ": held by " + strings.Join(held, "; ")
+}
+
+// Unwrap returns the underlying errno, so AddrInUseError matches
+// syscall.EADDRINUSE with errors.Is.
+func (e *AddrInUseError) Unwrap() error {
+	return e.Err
+}
+
+// bindError turns EADDRINUSE from bind into an AddrInUseError naming the
+// sockets in the way of a socket bound to device, if not empty. Other
+// errors are returned as they are.
+func bindError(proto, addr, device string, err error) error {
+	if err != syscall.EADDRINUSE {
+		return err
+	}
+
+	e := &AddrInUseError{Net: proto, Addr: addr, Err: err}
+
+	siblings, serr := findSiblings(proto, addr, addrInUseStates)
+	if serr != nil {
+		return e
+	}
+	siblings = boundSiblings(siblings)
+
+	var ip net.IP
+	if a, err := net.ResolveUDPAddr("udp", addr); err == nil {
+		ip = a.IP
+	}
+
+	var ifIndex int
+	if device != "" {
+		if ifi, err := net.InterfaceByName(device); err == nil {
+			ifIndex = ifi.Index
+		}
+	}
+
+	uid := uint32(syscall.Geteuid())
+	for _, s := range siblings {
+		// Sockets bound to another device are not in the way.
+		if !devicesOverlap(ifIndex, s.IfIndex) {
+			continue
+		}
+
+		c := AddrConflict{Sibling: s, OtherUID: s.UID != uid}
+		if s.ReusePortKnown {
+			c.NoReusePort = !s.ReusePort
+		} else {
+			c.NoReusePort = !c.OtherUID && sameIP(ip, siblingIP(s)) && s.IfIndex == ifIndex
+		}
+		e.Conflicts = append(e.Conflicts, c)
+	}
+	return e
+}
+
+// boundSiblings keeps the listening and bound-only sockets of siblings if
+// there are any, rather than reporting every connection of a listener.
+func boundSiblings(siblings []Sibling) []Sibling {
+	var bound []Sibling
+	for _, s := range siblings {
+		switch s.State {
+		case tcpListen, tcpClose, tcpBoundInactive:
+			bound = append(bound, s)
+		}
+	}
+
+	if len(bound) == 0 {
+		return siblings
+	}
+	return bound
+}
+
+func siblingIP(s Sibling) net.IP {
+	switch a := s.Addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// sameIP reports whether a and b are the same address, taking a nil IP as
+// the unspecified one.
+func sameIP(a, b net.IP) bool {
+	if a == nil || a.IsUnspecified() {
+		return b == nil || b.IsUnspecified()
+	}
+	return a.Equal(b)
+}
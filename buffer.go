@@ -0,0 +1,72 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// BufferSizeError is returned when the kernel granted a smaller socket
+// buffer than requested, usually because of the net.core.rmem_max or
+// net.core.wmem_max sysctls. It is the Err of an *Error whose Op names the
+// option.
+type BufferSizeError struct {
+	Option    string // SO_RCVBUF or SO_SNDBUF
+	Requested int    // size passed to WithReadBuffer or WithWriteBuffer
+	Granted   int    // size reported by the kernel, see BufferSizes
+}
+
+func (e *BufferSizeError) Error() string {
+	return fmt.Sprintf("requested %d bytes, kernel granted %d", e.Requested, e.Granted)
+}
+
+// BufferSizes returns the effective receive and send buffer sizes of a
+// listener or conn, as reported by SO_RCVBUF and SO_SNDBUF. Linux reports
+// twice the requested size, to account for its bookkeeping overhead.
+func BufferSizes(c syscall.Conn) (read, write int, err error) {
+	err = control(c, func(fd int) (err error) {
+		if read, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err != nil {
+			return err
+		}
+
+		write, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		return err
+	})
+	return read, write, err
+}
+
+// setBufferSize sets the buffer option opt to size, through forceOpt if
+// force is set and the platform has one. It falls back to opt when the
+// process lacks the privilege for forceOpt, and reports a *BufferSizeError
+// if the kernel granted less than size.
+func setBufferSize(fd int, name string, opt, forceOpt, size int, force bool) error {
+	var err error = syscall.EPERM
+	if force && forceOpt >= 0 {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, forceOpt, size)
+	}
+
+	if err == syscall.EPERM {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, opt, size)
+	}
+	if err != nil {
+		return sockoptError(name, err)
+	}
+
+	granted, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, opt)
+	if err != nil {
+		return &Error{Op: "getsockopt:" + name, Err: err}
+	}
+
+	if granted < size*bufferOverhead {
+		return sockoptError(name, &BufferSizeError{Option: name, Requested: size, Granted: granted})
+	}
+
+	return nil
+}
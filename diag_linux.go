@@ -0,0 +1,341 @@
+// +build linux
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sockDiagByFamily = 0x14 // SOCK_DIAG_BY_FAMILY
+
+	tcpEstablished   = 1
+	tcpSynRecv       = 3
+	tcpTimeWait      = 6
+	tcpClose         = 7
+	tcpListen        = 10
+	tcpNewSynRecv    = 12
+	tcpBoundInactive = 13 // bound but not listening, dumped by Linux 6.4 and later
+)
+
+// inetDiagSockID mirrors struct inet_diag_sockid from linux/inet_diag.h.
+// Ports and addresses are in network byte order.
+type inetDiagSockID struct {
+	Sport  [2]byte
+	Dport  [2]byte
+	Src    [16]byte
+	Dst    [16]byte
+	If     uint32
+	Cookie [2]uint32
+}
+
+// inetDiagReqV2 mirrors struct inet_diag_req_v2.
+type inetDiagReqV2 struct {
+	Family   uint8
+	Protocol uint8
+	Ext      uint8
+	Pad      uint8
+	States   uint32
+	ID       inetDiagSockID
+}
+
+// inetDiagMsg mirrors struct inet_diag_msg.
+type inetDiagMsg struct {
+	Family  uint8
+	State   uint8
+	Timer   uint8
+	Retrans uint8
+	ID      inetDiagSockID
+	Expires uint32
+	RQueue  uint32
+	WQueue  uint32
+	UID     uint32
+	Inode   uint32
+}
+
+// Siblings returns every listening TCP socket or every UDP socket bound to
+// addr, or to a wildcard address covering it, in the network namespace of
+// the calling process. It asks the kernel through NETLINK_SOCK_DIAG, so it
+// sees the sockets of all processes, and maps them to their processes
+// through /proc.
+func Siblings(proto, addr string) ([]Sibling, error) {
+	return findSiblings(proto, addr, 1<<tcpListen)
+}
+
+// findSiblings is Siblings for TCP sockets in any of tcpStates, a bitmask
+// of TCP states.
+func findSiblings(proto, addr string, tcpStates uint32) ([]Sibling, error) {
+	var (
+		ip       net.IP
+		port     int
+		protocol uint8
+		states   uint32
+	)
+
+	switch proto {
+	case "tcp", "tcp4", "tcp6":
+		tcp, err := net.ResolveTCPAddr(proto, addr)
+		if err != nil {
+			return nil, err
+		}
+		ip, port = tcp.IP, tcp.Port
+		protocol, states = syscall.IPPROTO_TCP, tcpStates
+	case "udp", "udp4", "udp6":
+		udp, err := net.ResolveUDPAddr(proto, addr)
+		if err != nil {
+			return nil, err
+		}
+		ip, port = udp.IP, udp.Port
+		protocol, states = syscall.IPPROTO_UDP, 1<<tcpClose|1<<tcpEstablished
+	default:
+		return nil, net.UnknownNetworkError(proto)
+	}
+
+	var families []uint8
+	switch proto[len(proto)-1] {
+	case '4':
+		families = []uint8{syscall.AF_INET}
+	case '6':
+		families = []uint8{syscall.AF_INET6}
+	default:
+		families = []uint8{syscall.AF_INET, syscall.AF_INET6}
+	}
+
+	var siblings []Sibling
+	for _, family := range families {
+		msgs, err := inetDiagDump(family, protocol, states)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range msgs {
+			local := net.IP(m.ID.Src[:16])
+			if family == syscall.AF_INET {
+				local = net.IP(m.ID.Src[:4])
+			}
+
+			if int(m.ID.Sport[0])<<8|int(m.ID.Sport[1]) != port || !addrsOverlap(ip, local) {
+				continue
+			}
+
+			s := Sibling{
+				State:   m.State,
+				UID:     m.UID,
+				Inode:   uint64(m.Inode),
+				Cookie:  uint64(m.ID.Cookie[0]) | uint64(m.ID.Cookie[1])<<32,
+				IfIndex: int(m.ID.If),
+				RecvQ:   m.RQueue,
+				SendQ:   m.WQueue,
+			}
+			if protocol == syscall.IPPROTO_TCP {
+				s.Addr = &net.TCPAddr{IP: local, Port: port}
+			} else {
+				s.Addr = &net.UDPAddr{IP: local, Port: port}
+			}
+			siblings = append(siblings, s)
+		}
+	}
+
+	return siblings, resolveSiblings(siblings)
+}
+
+// addrsOverlap reports whether sockets bound to a and b on the same port
+// may receive the same traffic.
+func addrsOverlap(a, b net.IP) bool {
+	return a == nil || a.IsUnspecified() || b.IsUnspecified() || a.Equal(b)
+}
+
+// devicesOverlap reports whether sockets bound to the interfaces with
+// index a and b, zero for none, may receive the same traffic and so
+// conflict on the same address.
+func devicesOverlap(a, b int) bool {
+	return a == 0 || b == 0 || a == b
+}
+
+// resolveSiblings fills in the processes and the SO_REUSEPORT state of
+// siblings.
+func resolveSiblings(siblings []Sibling) error {
+	byInode := make(map[uint64]*Sibling, len(siblings))
+	for i := range siblings {
+		byInode[siblings[i].Inode] = &siblings[i]
+	}
+
+	pid := os.Getpid()
+	err := walkSocketFds(func(p, fd int, inode uint64) {
+		s, ok := byInode[inode]
+		if !ok {
+			return
+		}
+
+		if len(s.Processes) == 0 || s.Processes[len(s.Processes)-1].PID != p {
+			s.Processes = append(s.Processes, Process{PID: p, Command: processCommand(p), Cgroup: processCgroup(p)})
+		}
+
+		if p == pid && !s.ReusePortKnown {
+			if v, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, reusePort); err == nil {
+				s.ReusePort, s.ReusePortKnown = v != 0, true
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// The kernel only lets sockets of the same kind share an exact
+	// address, on overlapping devices, when all of them have SO_REUSEPORT
+	// set. UDP sockets may share one with SO_REUSEADDR alone, so they are
+	// left out.
+	for i := range siblings {
+		s := &siblings[i]
+		if s.ReusePortKnown || s.State != tcpListen {
+			continue
+		}
+
+		for j := range siblings {
+			o := &siblings[j]
+			if i != j && o.State == tcpListen && o.Addr.String() == s.Addr.String() && devicesOverlap(o.IfIndex, s.IfIndex) {
+				s.ReusePort, s.ReusePortKnown = true, true
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// walkSocketFds calls fn for every socket file descriptor found in
+// /proc/<pid>/fd, skipping processes that cannot be inspected.
+func walkSocketFds(fn func(pid, fd int, inode uint64)) error {
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return err
+	}
+
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+
+		dir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, f := range fds {
+			link, err := os.Readlink(filepath.Join(dir, f.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+
+			inode, err := strconv.ParseUint(strings.TrimSuffix(link[len("socket:["):], "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+
+			fd, _ := strconv.Atoi(f.Name())
+			fn(pid, fd, inode)
+		}
+	}
+	return nil
+}
+
+func processCommand(pid int) string {
+	b, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// processCgroup returns the cgroup v2 path of a process, or an empty string
+// on hosts without the unified hierarchy.
+func processCgroup(pid int) string {
+	b, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return line[len("0::"):]
+		}
+	}
+	return ""
+}
+
+// inetDiagDump returns the inet_diag_msg of every socket of the given
+// family and protocol whose state is in the states bitmask.
+func inetDiagDump(family, protocol uint8, states uint32) ([]inetDiagMsg, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_INET_DIAG)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	var req struct {
+		Header syscall.NlMsghdr
+		Req    inetDiagReqV2
+	}
+	req.Header = syscall.NlMsghdr{
+		Len:   uint32(unsafe.Sizeof(req)),
+		Type:  sockDiagByFamily,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_DUMP,
+		Seq:   1,
+	}
+	req.Req = inetDiagReqV2{Family: family, Protocol: protocol, States: states}
+
+	b := (*[unsafe.Sizeof(req)]byte)(unsafe.Pointer(&req))[:]
+	if err = syscall.Sendto(fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var (
+		msgs []inetDiagMsg
+		buf  = make([]byte, 32*1024)
+	)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		nlmsgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range nlmsgs {
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return msgs, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, syscall.EINVAL
+				}
+				if errno := -int32(nativeEndian.Uint32(m.Data)); errno != 0 {
+					return nil, syscall.Errno(errno)
+				}
+				return msgs, nil
+			}
+
+			if len(m.Data) < int(unsafe.Sizeof(inetDiagMsg{})) {
+				continue
+			}
+			msgs = append(msgs, *(*inetDiagMsg)(unsafe.Pointer(&m.Data[0])))
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// +build linux
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// DropCountingConn is a UDP packet conn that remembers the SO_RXQ_OVFL drop
+// count of the last datagram it read. The wrapped conn must have been created
+// WithDropCounter.
+type DropCountingConn struct {
+	*net.UDPConn
+
+	drops uint32
+}
+
+// CountDrops wraps c, which must be a *net.UDPConn such as one returned by
+// NewReusablePortPacketConn, into a DropCountingConn.
+func CountDrops(c net.PacketConn) (*DropCountingConn, error) {
+	uc, ok := c.(*net.UDPConn)
+	if !ok {
+		return nil, errNotUDPConn
+	}
+
+	return &DropCountingConn{UDPConn: uc}, nil
+}
+
+// Drops returns the cumulative number of datagrams the kernel dropped on the
+// socket, as of the last datagram read from it.
+func (c *DropCountingConn) Drops() uint32 {
+	return atomic.LoadUint32(&c.drops)
+}
+
+// ReadMsgUDP acts like net.UDPConn.ReadMsgUDP and records the drop count of
+// the datagram read. If oob is empty, an internal buffer is used instead.
+func (c *DropCountingConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	if len(oob) == 0 {
+		oob = make([]byte, oobSize)
+	}
+
+	n, oobn, flags, addr, err = c.UDPConn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return n, oobn, flags, addr, err
+	}
+
+	if cm, cmErr := parseControlMessage(oob[:oobn]); cmErr == nil && cm.Drops != 0 {
+		atomic.StoreUint32(&c.drops, cm.Drops)
+	}
+
+	return n, oobn, flags, addr, err
+}
+
+// ReadFromUDP acts like net.UDPConn.ReadFromUDP and records the drop count
+// of the datagram read.
+func (c *DropCountingConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	n, _, _, addr, err := c.ReadMsgUDP(b, nil)
+	return n, addr, err
+}
+
+// ReadFrom implements net.PacketConn and records the drop count of the
+// datagram read.
+func (c *DropCountingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.ReadFromUDP(b)
+	if addr == nil {
+		return n, nil, err
+	}
+	return n, addr, err
+}
+
+// Read implements net.Conn and records the drop count of the datagram read.
+func (c *DropCountingConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFromUDP(b)
+	return n, err
+}
+
+// DropCountingGroup is a set of sockets sharing a port, typically the shards
+// of one reuseport group.
+type DropCountingGroup []*DropCountingConn
+
+// Drops returns the sum of the drop counts of all sockets in the group.
+func (g DropCountingGroup) Drops() uint64 {
+	var total uint64
+	for _, c := range g {
+		total += uint64(c.Drops())
+	}
+	return total
+}
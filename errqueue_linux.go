@@ -0,0 +1,270 @@
+// +build linux
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ErrOrigin is the origin of an error queue message (ee_origin).
+type ErrOrigin uint8
+
+// Values of sock_extended_err.ee_origin from linux/errqueue.h.
+const (
+	ErrOriginNone  ErrOrigin = 0
+	ErrOriginLocal ErrOrigin = 1
+	ErrOriginICMP  ErrOrigin = 2
+	ErrOriginICMP6 ErrOrigin = 3
+
+	// ErrOriginTimestamping marks transmit timestamps reported by sockets
+	// created WithTxTimestamps. Errno is ENOMSG for these.
+	ErrOriginTimestamping ErrOrigin = 4
+
+	// ErrOriginZeroCopy marks MSG_ZEROCOPY completion notifications, see
+	// ZeroCopyConn.
+	ErrOriginZeroCopy ErrOrigin = 5
+)
+
+func (o ErrOrigin) String() string {
+	switch o {
+	case ErrOriginNone:
+		return "none"
+	case ErrOriginLocal:
+		return "local"
+	case ErrOriginICMP:
+		return "icmp"
+	case ErrOriginICMP6:
+		return "icmp6"
+	case ErrOriginTimestamping:
+		return "timestamping"
+	case ErrOriginZeroCopy:
+		return "zerocopy"
+	}
+	return fmt.Sprintf("origin(%d)", uint8(o))
+}
+
+// sockExtendedErr mirrors struct sock_extended_err from linux/errqueue.h.
+type sockExtendedErr struct {
+	Errno  uint32
+	Origin uint8
+	Type   uint8
+	Code   uint8
+	Pad    uint8
+	Info   uint32
+	Data   uint32
+}
+
+const sizeofSockExtendedErr = int(unsafe.Sizeof(sockExtendedErr{}))
+
+// ExtendedError is a parsed sock_extended_err record read from the socket
+// error queue with ReadErrQueue.
+type ExtendedError struct {
+	Errno  syscall.Errno
+	Origin ErrOrigin
+	Type   uint8  // ICMP type, if Origin is ErrOriginICMP or ErrOriginICMP6
+	Code   uint8  // ICMP code, if Origin is ErrOriginICMP or ErrOriginICMP6
+	Info   uint32 // e.g. the path MTU for EMSGSIZE
+	Data   uint32
+
+	// Offender is the host that generated the error, e.g. the router that
+	// sent the ICMP message. It is nil for locally generated errors.
+	Offender net.IP
+
+	// Addr is the destination of the packet that caused the error.
+	Addr net.Addr
+
+	// Timestamp is the transmit timestamp for ErrOriginTimestamping
+	// records. On UDP sockets Data then holds the counter of the
+	// timestamped datagram.
+	Timestamp time.Time
+}
+
+func (e *ExtendedError) Error() string {
+	s := fmt.Sprintf("%s (origin %s, type %d, code %d)", e.Errno.Error(), e.Origin, e.Type, e.Code)
+	if e.Offender != nil {
+		s += " from " + e.Offender.String()
+	}
+	return s
+}
+
+// Unwrap returns the underlying errno, so ExtendedError can be matched with
+// errors.Is, e.g. against syscall.ECONNREFUSED or syscall.EHOSTUNREACH.
+func (e *ExtendedError) Unwrap() error {
+	return e.Errno
+}
+
+// ReadErrQueue drains the socket error queue without blocking and returns
+// the records found in it. The socket must have been created
+// WithExtendedErrors or WithTxTimestamps.
+func ReadErrQueue(c syscall.Conn) (errs []ExtendedError, err error) {
+	err = control(c, func(fd int) error {
+		for {
+			e, err := readErrQueue(fd, nil)
+			if err != nil || e == nil {
+				return err
+			}
+
+			errs = append(errs, *e)
+		}
+	})
+	return errs, err
+}
+
+// PathMTUError is reported when a datagram did not fit the path MTU, either
+// because the local stack refused it or because a router sent back an ICMP
+// "fragmentation needed" (ICMPv6 "packet too big") message.
+type PathMTUError struct {
+	MTU  int    // path MTU reported by the kernel
+	From net.IP // router that reported the error, nil for local errors
+}
+
+func (e *PathMTUError) Error() string {
+	if e.From == nil {
+		return fmt.Sprintf("message too long: path MTU is %d", e.MTU)
+	}
+	return fmt.Sprintf("message too long: path MTU is %d (reported by %s)", e.MTU, e.From)
+}
+
+// Unwrap returns syscall.EMSGSIZE, so PathMTUError matches it with errors.Is.
+func (e *PathMTUError) Unwrap() error {
+	return syscall.EMSGSIZE
+}
+
+// PathMTU returns the current path MTU (IP_MTU or IPV6_MTU) of a connected
+// socket.
+func PathMTU(c syscall.Conn) (mtu int, err error) {
+	err = control(c, func(fd int) error {
+		family, err := socketFamily(fd)
+		if err != nil {
+			return err
+		}
+
+		if family == syscall.AF_INET6 {
+			mtu, err = syscall.GetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MTU)
+		} else {
+			mtu, err = syscall.GetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU)
+		}
+		return err
+	})
+	return mtu, err
+}
+
+// PathMTUError returns the *PathMTUError described by e, or nil if e is not
+// a path MTU error. It picks path MTU errors out of records already read
+// with ReadErrQueue.
+func (e *ExtendedError) PathMTUError() *PathMTUError {
+	if e.Errno != syscall.EMSGSIZE {
+		return nil
+	}
+
+	mtuErr := &PathMTUError{MTU: int(e.Info)}
+	if e.Origin != ErrOriginLocal {
+		mtuErr.From = e.Offender
+	}
+	return mtuErr
+}
+
+// ReadPathMTUError drains the socket error queue and returns the latest
+// *PathMTUError found in it, or nil if there is none. The socket must have
+// been created WithPathMTUDiscovery(PMTUDDo) or PMTUDProbe.
+//
+// Every other record in the queue, such as ICMP unreachables and transmit
+// timestamps, is discarded. Sockets that need those should call
+// ReadErrQueue and ExtendedError.PathMTUError instead.
+func ReadPathMTUError(c syscall.Conn) error {
+	errs, err := ReadErrQueue(c)
+	if err != nil {
+		return err
+	}
+
+	for i := len(errs) - 1; i >= 0; i-- {
+		if mtuErr := errs[i].PathMTUError(); mtuErr != nil {
+			return mtuErr
+		}
+	}
+
+	return nil
+}
+
+// errQueueOOBSize fits an IP_RECVERR record with its offender address and
+// an SCM_TIMESTAMPING record.
+var errQueueOOBSize = syscall.CmsgSpace(sizeofSockExtendedErr+syscall.SizeofSockaddrInet6) +
+	syscall.CmsgSpace(3*sizeofTimespec)
+
+// readErrQueue reads one message from the error queue of fd without
+// blocking. It returns nil if the queue is empty. The payload of the
+// original packet, if any, is copied into p.
+func readErrQueue(fd int, p []byte) (*ExtendedError, error) {
+	oob := make([]byte, errQueueOOBSize)
+
+	_, oobn, _, from, err := syscall.Recvmsg(fd, p, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+	if err == syscall.EAGAIN {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		e  *ExtendedError
+		ts time.Time
+	)
+
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_RECVERR,
+			m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_RECVERR:
+			if len(m.Data) < sizeofSockExtendedErr {
+				return nil, syscall.EINVAL
+			}
+
+			ee := (*sockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+
+			e = &ExtendedError{
+				Errno:    syscall.Errno(ee.Errno),
+				Origin:   ErrOrigin(ee.Origin),
+				Type:     ee.Type,
+				Code:     ee.Code,
+				Info:     ee.Info,
+				Data:     ee.Data,
+				Offender: parseOffender(m.Data[sizeofSockExtendedErr:]),
+			}
+			if addr := sockaddrToUDPAddr(from); addr != nil {
+				e.Addr = addr
+			}
+		case m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SCM_TIMESTAMPING:
+			ts = parseTimespec(m.Data)
+		}
+	}
+
+	if e == nil {
+		return nil, syscall.EINVAL
+	}
+
+	e.Timestamp = ts
+	return e, nil
+}
+
+// parseOffender decodes the raw sockaddr that follows sock_extended_err
+// (SO_EE_OFFENDER). It returns nil if the kernel did not supply one.
+func parseOffender(b []byte) net.IP {
+	if addr := parseRawSockaddr(b); addr != nil {
+		return addr.IP
+	}
+	return nil
+}
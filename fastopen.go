@@ -0,0 +1,56 @@
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errInvalidFastOpenKey = errors.New("TCP Fast Open key must look like xxxxxxxx-xxxxxxxx-xxxxxxxx-xxxxxxxx")
+
+// FastOpenKey is a 128-bit TCP Fast Open cookie key.
+type FastOpenKey [16]byte
+
+// ParseFastOpenKey parses a key in the format of the
+// net.ipv4.tcp_fastopen_key sysctl: four groups of up to eight hex digits
+// separated by dashes. If s holds a primary and a backup key separated by a
+// comma, only the primary one is returned.
+func ParseFastOpenKey(s string) (key FastOpenKey, err error) {
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		s = s[:i]
+	}
+
+	groups := strings.Split(strings.TrimSpace(s), "-")
+	if len(groups) != 4 {
+		return key, errInvalidFastOpenKey
+	}
+
+	for i, g := range groups {
+		v, err := strconv.ParseUint(g, 16, 32)
+		if err != nil {
+			return key, errInvalidFastOpenKey
+		}
+
+		// The kernel stores every group as a little-endian u32.
+		binary.LittleEndian.PutUint32(key[i*4:], uint32(v))
+	}
+
+	return key, nil
+}
+
+// String formats k the way the net.ipv4.tcp_fastopen_key sysctl does.
+func (k FastOpenKey) String() string {
+	return fmt.Sprintf("%08x-%08x-%08x-%08x",
+		binary.LittleEndian.Uint32(k[0:]),
+		binary.LittleEndian.Uint32(k[4:]),
+		binary.LittleEndian.Uint32(k[8:]),
+		binary.LittleEndian.Uint32(k[12:]))
+}
@@ -0,0 +1,37 @@
+// +build linux
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"net"
+	"syscall"
+)
+
+const (
+	tcpFastOpen    = 0x17 // TCP_FASTOPEN
+	tcpFastOpenKey = 0x21 // TCP_FASTOPEN_KEY
+
+	tcpiOptSynData = 0x20 // TCPI_OPT_SYN_DATA
+)
+
+// FastOpened reports whether the accepted conn c was opened with TCP Fast
+// Open, i.e. the data carried by the client's SYN was accepted.
+func FastOpened(c net.Conn) (bool, error) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return false, syscall.EINVAL
+	}
+
+	stats, err := TCPInfo(sc)
+	if err != nil {
+		return false, err
+	}
+
+	return stats.Options&tcpiOptSynData != 0, nil
+}
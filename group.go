@@ -0,0 +1,107 @@
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Process is a process holding a socket.
+type Process struct {
+	PID     int
+	Command string // contents of /proc/<pid>/comm
+	Cgroup  string // cgroup v2 path from /proc/<pid>/cgroup, if any
+}
+
+// Sibling describes a socket bound to the address passed to Siblings.
+type Sibling struct {
+	Addr   net.Addr // local address, a *net.TCPAddr or a *net.UDPAddr
+	State  uint8    // TCP_LISTEN for listeners; TCP_CLOSE or TCP_ESTABLISHED for UDP
+	UID    uint32
+	Inode  uint64
+	Cookie uint64 // SO_COOKIE of the socket
+
+	// IfIndex is the index of the interface the socket is bound to with
+	// SO_BINDTODEVICE, or zero.
+	IfIndex int
+
+	// RecvQ and SendQ are the accept queue length and limit of a
+	// listener, or the bytes queued for receiving and sending on a UDP
+	// socket.
+	RecvQ uint32
+	SendQ uint32
+
+	// ReusePort reports whether SO_REUSEPORT is set on the socket. It is
+	// only known, as ReusePortKnown tells, for sockets of this process
+	// and for sockets that share their address and device with another
+	// one of the same kind, which the kernel only allows with
+	// SO_REUSEPORT.
+	ReusePort      bool
+	ReusePortKnown bool
+
+	// Processes holds the processes with the socket open. Processes
+	// whose /proc/<pid>/fd is not readable, usually because they belong
+	// to another user, are missing.
+	Processes []Process
+}
+
+// owners names the processes holding s, like "nginx (pid 1234)".
+func (s Sibling) owners() string {
+	if len(s.Processes) == 0 {
+		return "a socket of an unknown process"
+	}
+
+	owners := make([]string, len(s.Processes))
+	for i, p := range s.Processes {
+		owners[i] = fmt.Sprintf("%s (pid %d)", p.Command, p.PID)
+	}
+	return strings.Join(owners, ", ")
+}
+
+// ExclusiveGroup configures WithExclusiveGroup.
+type ExclusiveGroup struct {
+	// Allow reports whether a socket found on the address is expected.
+	// When nil, sockets held by this process or by a process in the same
+	// cgroup are.
+	Allow func(Sibling) bool
+
+	// Interval is the time between checks once the socket is created.
+	// Zero only checks once, when it is created.
+	Interval time.Duration
+
+	// OnIntruder is called from a background goroutine with the
+	// unexpected sockets that a periodic check finds for the first time;
+	// each socket is reported once. Periodic checks run when Interval and
+	// OnIntruder or OnError are set, and stop once the socket is closed.
+	OnIntruder func(addr net.Addr, intruders []Sibling)
+
+	// OnError is called from the same goroutine with the error of every
+	// periodic check that fails, such as when the network namespace the
+	// socket was created in is gone. Checks go on at Interval regardless,
+	// so a failure that persists is reported once per Interval. Without
+	// OnError, failed checks are skipped silently.
+	OnError func(addr net.Addr, err error)
+}
+
+// GroupIntruderError is returned by NewReusablePortListener and
+// NewReusablePortPacketConn when WithExclusiveGroup finds unexpected
+// sockets on the address.
+type GroupIntruderError struct {
+	Addr      net.Addr
+	Intruders []Sibling
+}
+
+func (e *GroupIntruderError) Error() string {
+	held := make([]string, len(e.Intruders))
+	for i, s := range e.Intruders {
+		held[i] = fmt.Sprintf("%s, uid %d", s.owners(), s.UID)
+	}
+	return fmt.Sprintf("unexpected sockets on %s: %s", e.Addr, strings.Join(held, "; "))
+}
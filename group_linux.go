@@ -0,0 +1,120 @@
+// +build linux
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// guardGroup checks the sockets on addr, the local address of c, against
+// cfg.exclusive, and keeps checking them in the background until c is
+// closed if asked to.
+func guardGroup(c syscall.Conn, addr net.Addr, cfg *config) error {
+	g := cfg.exclusive
+	if g == nil {
+		return nil
+	}
+
+	allow := g.Allow
+	if allow == nil {
+		allow = sameProcessOrCgroup()
+	}
+
+	intruders, err := groupIntruders(addr, allow, cfg.netns)
+	if err != nil {
+		return err
+	}
+	if len(intruders) > 0 {
+		return &GroupIntruderError{Addr: addr, Intruders: intruders}
+	}
+
+	if g.Interval > 0 && (g.OnIntruder != nil || g.OnError != nil) {
+		go watchGroup(c, addr, allow, g, cfg.netns)
+	}
+	return nil
+}
+
+// watchGroup runs the periodic checks of guardGroup until c is closed,
+// reporting failed checks to g.OnError and intruders to g.OnIntruder once,
+// by the cookie of their socket.
+func watchGroup(c syscall.Conn, addr net.Addr, allow func(Sibling) bool, g *ExclusiveGroup, netns string) {
+	t := time.NewTicker(g.Interval)
+	defer t.Stop()
+
+	var reported map[uint64]bool
+
+	for range t.C {
+		// Control fails once c is closed.
+		if err := control(c, func(int) error { return nil }); err != nil {
+			return
+		}
+
+		intruders, err := groupIntruders(addr, allow, netns)
+		if err != nil {
+			if g.OnError != nil {
+				g.OnError(addr, &Error{Op: "groupcheck", Net: addr.Network(), Addr: addr.String(), Err: err})
+			}
+			continue
+		}
+
+		// Only the sockets still there are remembered; cookies are not
+		// reused.
+		seen := make(map[uint64]bool, len(intruders))
+		var fresh []Sibling
+		for _, s := range intruders {
+			seen[s.Cookie] = true
+			if !reported[s.Cookie] {
+				fresh = append(fresh, s)
+			}
+		}
+		reported = seen
+
+		if len(fresh) > 0 && g.OnIntruder != nil {
+			g.OnIntruder(addr, fresh)
+		}
+	}
+}
+
+// groupIntruders returns the sockets on addr, in the network namespace at
+// netns if set, that allow rejects.
+func groupIntruders(addr net.Addr, allow func(Sibling) bool, netns string) ([]Sibling, error) {
+	var siblings []Sibling
+	if err := inNetns(netns, func() (err error) {
+		siblings, err = Siblings(addr.Network(), addr.String())
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	var intruders []Sibling
+	for _, s := range siblings {
+		if !allow(s) {
+			intruders = append(intruders, s)
+		}
+	}
+	return intruders, nil
+}
+
+// sameProcessOrCgroup is the default ExclusiveGroup.Allow.
+func sameProcessOrCgroup() func(Sibling) bool {
+	pid := os.Getpid()
+	cgroup := processCgroup(pid)
+
+	return func(s Sibling) bool {
+		for _, p := range s.Processes {
+			if p.PID == pid || cgroup != "" && p.Cgroup == cgroup {
+				return true
+			}
+		}
+		return false
+	}
+}
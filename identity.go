@@ -0,0 +1,197 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrNotInherited is returned by InheritedListener and InheritedPacketConn
+// when no inherited socket matches.
+var ErrNotInherited = errors.New("no inherited socket matches")
+
+// SocketID identifies a socket created by NewReusablePortListener or
+// NewReusablePortPacketConn, to correlate it with kernel and BPF telemetry
+// and with the sockets listed by Siblings.
+type SocketID struct {
+	// Cookie is SO_COOKIE, the number BPF programs see for the socket
+	// (bpf_get_socket_cookie). It never changes and is never reused while
+	// the system runs. Linux only; zero elsewhere.
+	Cookie uint64
+
+	// Inode is the inode number of the socket, as in the socket:[inode]
+	// links of /proc/<pid>/fd.
+	Inode uint64
+
+	Net  string // "tcp4", "tcp6", "udp4" or "udp6"
+	Addr string // local address
+}
+
+func (id SocketID) String() string {
+	return fmt.Sprintf("%s.%s.cookie=%d.inode=%d", id.Net, id.Addr, id.Cookie, id.Inode)
+}
+
+// Identity returns the identity of a listener or packet conn created by the
+// package, or of a conn accepted from such a listener.
+func Identity(c syscall.Conn) (id SocketID, err error) {
+	err = control(c, func(fd int) (err error) {
+		id, err = identify(fd)
+		return err
+	})
+	return id, err
+}
+
+func identify(fd int) (SocketID, error) {
+	var id SocketID
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return id, err
+	}
+	id.Inode = uint64(st.Ino)
+
+	cookie, err := socketCookie(fd)
+	if err != nil {
+		return id, err
+	}
+	id.Cookie = cookie
+
+	soType, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return id, err
+	}
+
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return id, err
+	}
+
+	id.Net = "udp"
+	if soType == syscall.SOCK_STREAM {
+		id.Net = "tcp"
+	}
+
+	switch sa.(type) {
+	case *syscall.SockaddrInet4:
+		id.Net += "4"
+	case *syscall.SockaddrInet6:
+		id.Net += "6"
+	default:
+		return id, syscall.EAFNOSUPPORT
+	}
+	id.Addr = sockaddrToUDPAddr(sa).String()
+
+	return id, nil
+}
+
+// matches reports whether the socket other is the one id describes: by
+// Cookie if it is set, else by Inode if it is set, else by Net and Addr,
+// where Net "tcp" or "udp" matches either address family.
+func (id SocketID) matches(other SocketID) bool {
+	switch {
+	case id.Cookie != 0:
+		return id.Cookie == other.Cookie
+	case id.Inode != 0:
+		return id.Inode == other.Inode
+	}
+
+	if !strings.HasPrefix(other.Net, id.Net) {
+		return false
+	}
+	sa, _, err := getSockaddr(other.Net, id.Addr)
+	if err != nil {
+		return false
+	}
+	return sockaddrToUDPAddr(sa).String() == other.Addr
+}
+
+// InheritedListener returns a listener for the inherited socket that id
+// describes, such as a SocketID a parent process logged before passing its
+// listener on across exec. A SocketID with only Net and Addr set matches by
+// address, as in InheritedListener(SocketID{Net: "tcp4", Addr: ":8080"}).
+//
+// Inherited sockets are the open fds without close-on-exec, which the
+// process has not created itself, as the net package sets close-on-exec on
+// every fd. They are found through /dev/fd. The matching fd is closed once
+// the listener holds a duplicate of it. If none matches, ErrNotInherited is
+// returned.
+func InheritedListener(id SocketID) (net.Listener, error) {
+	file, err := inheritedFile(id, syscall.SOCK_STREAM)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return net.FileListener(file)
+}
+
+// InheritedPacketConn is InheritedListener for packet conns.
+func InheritedPacketConn(id SocketID) (net.PacketConn, error) {
+	file, err := inheritedFile(id, syscall.SOCK_DGRAM)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return net.FilePacketConn(file)
+}
+
+// inheritedFile returns the inherited socket of type soType that matches id,
+// named after its identity.
+func inheritedFile(id SocketID, soType int) (*os.File, error) {
+	dir, err := os.Open("/dev/fd")
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		fd, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+
+		flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0)
+		if errno != 0 || flags&syscall.FD_CLOEXEC != 0 {
+			continue
+		}
+
+		if t, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE); err != nil || t != soType {
+			continue
+		}
+
+		other, err := identify(fd)
+		if err != nil || !id.matches(other) {
+			continue
+		}
+		return os.NewFile(uintptr(fd), "reuseport."+other.String()), nil
+	}
+
+	return nil, ErrNotInherited
+}
+
+// socketFileName names the *os.File wrapping a new socket after its
+// identity, so that inherited fds can be told apart.
+func socketFileName(fd int, proto, addr string) string {
+	id, err := identify(fd)
+	if err != nil {
+		return "reuseport." + proto + "." + addr
+	}
+	return "reuseport." + id.String()
+}
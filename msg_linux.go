@@ -0,0 +1,320 @@
+// +build linux
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var errNotUDPConn = errors.New("only *net.UDPConn is supported")
+
+// udpConn is the part of *net.UDPConn that ReadMsg and WriteMsg need.
+type udpConn interface {
+	syscall.Conn
+	RemoteAddr() net.Addr
+	ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error)
+	WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error)
+}
+
+// ECN is an Explicit Congestion Notification codepoint, the two low-order
+// bits of the IPv4 TOS or IPv6 Traffic Class field.
+type ECN uint8
+
+// ECN codepoints from RFC 3168.
+const (
+	ECNNotECT ECN = 0x0 // Not ECN-Capable Transport
+	ECNECT1   ECN = 0x1 // ECN Capable Transport, ECT(1)
+	ECNECT0   ECN = 0x2 // ECN Capable Transport, ECT(0)
+	ECNCE     ECN = 0x3 // Congestion Experienced
+)
+
+const ecnMask = 0x3
+
+const ipv6OrigDstAddr = ipv6RecvOrigDstAddr // IPV6_ORIGDSTADDR
+
+func (e ECN) String() string {
+	switch e {
+	case ECNNotECT:
+		return "Not-ECT"
+	case ECNECT1:
+		return "ECT(1)"
+	case ECNECT0:
+		return "ECT(0)"
+	case ECNCE:
+		return "CE"
+	}
+	return fmt.Sprintf("ECN(%d)", uint8(e))
+}
+
+// ControlMessage holds the per-datagram ancillary data read by ReadMsg or
+// sent by WriteMsg.
+type ControlMessage struct {
+	// ECN is the ECN codepoint of a received datagram, or the codepoint
+	// to mark an outgoing datagram with. Receiving requires WithECN.
+	ECN ECN
+
+	// DSCP is the Differentiated Services codepoint of a received
+	// datagram, or the codepoint to mark an outgoing datagram with when
+	// HasDSCP is set. Receiving requires WithECN.
+	DSCP uint8
+
+	// HasDSCP is set when DSCP holds a codepoint. On send, datagrams
+	// without one keep the DSCP of the socket, see WithDSCP, which costs
+	// a getsockopt per datagram; callers that know it can pass it here.
+	HasDSCP bool
+
+	// Timestamp is the kernel receive timestamp of a datagram. It is
+	// only set on sockets created WithTimestamps.
+	Timestamp time.Time
+
+	// Drops is the cumulative number of datagrams the kernel dropped on
+	// the socket before this one was queued. It is only set on sockets
+	// created WithDropCounter.
+	Drops uint32
+
+	// Dst is the original destination of a received datagram. It is only
+	// set on sockets created WithOriginalDestination.
+	Dst *net.UDPAddr
+}
+
+const sizeofTimespec = int(unsafe.Sizeof(syscall.Timespec{}))
+
+// oobSize is large enough for every control message ReadMsg understands.
+var oobSize = syscall.CmsgSpace(4)*4 + syscall.CmsgSpace(sizeofTimespec) + syscall.CmsgSpace(3*sizeofTimespec) +
+	syscall.CmsgSpace(syscall.SizeofSockaddrInet6)
+
+// ReadMsg reads a single datagram from c into b, along with its control
+// message. c must be a *net.UDPConn, such as one returned by
+// NewReusablePortPacketConn, or a wrapper of one like DropCountingConn.
+func ReadMsg(c net.PacketConn, b []byte) (n int, cm *ControlMessage, addr *net.UDPAddr, err error) {
+	uc, ok := c.(udpConn)
+	if !ok {
+		return 0, nil, nil, errNotUDPConn
+	}
+
+	oob := make([]byte, oobSize)
+
+	n, oobn, _, addr, err := uc.ReadMsgUDP(b, oob)
+	if err != nil {
+		return n, nil, addr, err
+	}
+
+	cm, err = parseControlMessage(oob[:oobn])
+	return n, cm, addr, err
+}
+
+// ReadTimestamp reads data from a stream connection c into b and returns
+// the kernel receive timestamp of the data. The connection must have been
+// accepted from a listener created WithTimestamps. The timestamp is zero if
+// the kernel did not supply one.
+func ReadTimestamp(c net.Conn, b []byte) (n int, ts time.Time, err error) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return 0, ts, syscall.EINVAL
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, ts, err
+	}
+
+	var (
+		oob        = make([]byte, oobSize)
+		oobn       int
+		recvmsgErr error
+	)
+
+	err = rc.Read(func(fd uintptr) bool {
+		n, oobn, _, _, recvmsgErr = syscall.Recvmsg(int(fd), b, oob, 0)
+		return recvmsgErr != syscall.EAGAIN
+	})
+	if err == nil {
+		err = recvmsgErr
+	}
+	if err != nil {
+		return 0, ts, err
+	}
+
+	if n == 0 && len(b) > 0 {
+		return 0, ts, io.EOF
+	}
+
+	cm, err := parseControlMessage(oob[:oobn])
+	if err != nil {
+		return n, ts, err
+	}
+
+	return n, cm.Timestamp, nil
+}
+
+// WriteMsg writes a single datagram to addr via c, applying the settings in
+// cm to it. A nil cm sends b unchanged. c must be a *net.UDPConn, such as
+// one returned by NewReusablePortPacketConn, or a wrapper of one like
+// DropCountingConn.
+func WriteMsg(c net.PacketConn, b []byte, cm *ControlMessage, addr *net.UDPAddr) (n int, err error) {
+	uc, ok := c.(udpConn)
+	if !ok {
+		return 0, errNotUDPConn
+	}
+
+	var oob []byte
+	if cm != nil {
+		if oob, err = marshalControlMessage(uc, cm, addr); err != nil {
+			return 0, err
+		}
+	}
+
+	n, _, err = uc.WriteMsgUDP(b, oob, addr)
+	return n, err
+}
+
+func parseControlMessage(oob []byte) (*ControlMessage, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+
+	cm := &ControlMessage{}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_TOS:
+			if len(m.Data) >= 1 {
+				cm.ECN = ECN(m.Data[0] & ecnMask)
+				cm.DSCP, cm.HasDSCP = m.Data[0]>>2, true
+			}
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_TCLASS:
+			if len(m.Data) >= 4 {
+				tclass := nativeEndian.Uint32(m.Data)
+				cm.ECN = ECN(tclass & ecnMask)
+				cm.DSCP, cm.HasDSCP = uint8(tclass>>2)&0x3f, true
+			}
+		case m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SCM_TIMESTAMPNS,
+			m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SCM_TIMESTAMPING:
+			// The software timestamp comes first in struct scm_timestamping.
+			if ts := parseTimespec(m.Data); !ts.IsZero() {
+				cm.Timestamp = ts
+			}
+		case m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SO_RXQ_OVFL:
+			if len(m.Data) >= 4 {
+				cm.Drops = nativeEndian.Uint32(m.Data)
+			}
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_ORIGDSTADDR,
+			m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == ipv6OrigDstAddr:
+			cm.Dst = parseRawSockaddr(m.Data)
+		}
+	}
+
+	return cm, nil
+}
+
+// parseRawSockaddr decodes a struct sockaddr_in or sockaddr_in6. It
+// returns nil if b holds neither.
+func parseRawSockaddr(b []byte) *net.UDPAddr {
+	if len(b) < 2 {
+		return nil
+	}
+
+	switch *(*uint16)(unsafe.Pointer(&b[0])) {
+	case syscall.AF_INET:
+		if len(b) < syscall.SizeofSockaddrInet4 {
+			return nil
+		}
+		return &net.UDPAddr{
+			IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+			Port: int(b[2])<<8 | int(b[3]),
+		}
+	case syscall.AF_INET6:
+		if len(b) < syscall.SizeofSockaddrInet6 {
+			return nil
+		}
+		sa := &syscall.SockaddrInet6{
+			Port:   int(b[2])<<8 | int(b[3]),
+			ZoneId: nativeEndian.Uint32(b[24:]),
+		}
+		copy(sa.Addr[:], b[8:24])
+		return sockaddrToUDPAddr(sa)
+	}
+
+	return nil
+}
+
+// parseTimespec decodes a struct timespec at the start of b. It returns the
+// zero time if b is too short or holds a zero timespec.
+func parseTimespec(b []byte) time.Time {
+	if len(b) < sizeofTimespec {
+		return time.Time{}
+	}
+
+	ts := (*syscall.Timespec)(unsafe.Pointer(&b[0]))
+	if ts.Sec == 0 && ts.Nsec == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(ts.Unix())
+}
+
+// marshalControlMessage encodes cm for a datagram sent to addr via c, or
+// to the peer of c if addr is nil. IPv4 destinations, including v4-mapped
+// ones on a dual-stack socket, take IP_TOS; IPv6 destinations take
+// IPV6_TCLASS, since the kernel ignores IP_TOS for them.
+func marshalControlMessage(c udpConn, cm *ControlMessage, addr *net.UDPAddr) ([]byte, error) {
+	if cm.DSCP > 63 {
+		return nil, errInvalidDSCP
+	}
+
+	if addr == nil {
+		addr, _ = c.RemoteAddr().(*net.UDPAddr)
+	}
+
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+	if addr != nil && addr.IP.To4() == nil {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+
+	dscp := int(cm.DSCP)
+	if !cm.HasDSCP {
+		var err error
+		if dscp, err = socketDSCP(c, level, opt); err != nil {
+			return nil, err
+		}
+	}
+
+	return appendCmsgInt(nil, level, opt, dscp<<2|int(cm.ECN&ecnMask)), nil
+}
+
+// socketDSCP returns the DSCP set on c at the given IP level.
+func socketDSCP(c udpConn, level, opt int) (int, error) {
+	var dscp int
+	err := control(c, func(fd int) error {
+		tos, err := syscall.GetsockoptInt(fd, level, opt)
+		dscp = tos >> 2
+		return err
+	})
+	return dscp, err
+}
+
+// appendCmsgInt appends a control message carrying a single C int.
+func appendCmsgInt(b []byte, level, typ, v int) []byte {
+	off := len(b)
+	b = append(b, make([]byte, syscall.CmsgSpace(4))...)
+
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[off]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(syscall.CmsgLen(4))
+
+	nativeEndian.PutUint32(b[off+syscall.CmsgLen(0):], uint32(v))
+	return b
+}
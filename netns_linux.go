@@ -0,0 +1,111 @@
+// +build linux
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// ListenInNetns is like Listen, but creates the listener in the network
+// namespace at nsPath, such as /var/run/netns/blue or /proc/<pid>/ns/net.
+// The rest of the process stays in its own namespace, and the listener
+// keeps serving the other one from there. It requires CAP_SYS_ADMIN.
+func ListenInNetns(nsPath, proto, addr string, opts ...Option) (l net.Listener, err error) {
+	opts = append(opts[:len(opts):len(opts)], withNetns(nsPath))
+	err = inNetns(nsPath, func() (err error) {
+		l, err = NewReusablePortListener(proto, addr, opts...)
+		return err
+	})
+	if err != nil && l != nil {
+		l.Close()
+		l = nil
+	}
+	return l, err
+}
+
+// ListenPacketInNetns is like ListenPacket, but creates the packet conn in
+// the network namespace at nsPath. See ListenInNetns.
+func ListenPacketInNetns(nsPath, proto, addr string, opts ...Option) (c net.PacketConn, err error) {
+	opts = append(opts[:len(opts):len(opts)], withNetns(nsPath))
+	err = inNetns(nsPath, func() (err error) {
+		c, err = NewReusablePortPacketConn(proto, addr, opts...)
+		return err
+	})
+	if err != nil && c != nil {
+		c.Close()
+		c = nil
+	}
+	return c, err
+}
+
+// withNetns records the namespace a socket is created in, for the
+// periodic checks of WithExclusiveGroup.
+func withNetns(nsPath string) Option {
+	return func(c *config) {
+		c.netns = nsPath
+	}
+}
+
+// inNetns runs fn on an OS thread that has joined the network namespace at
+// nsPath, so sockets created by fn belong to it. An empty nsPath runs fn
+// as it is.
+func inNetns(nsPath string, fn func() error) error {
+	if nsPath == "" {
+		return fn()
+	}
+
+	ns, err := os.Open(nsPath)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		orig, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- err
+			return
+		}
+		defer orig.Close()
+
+		if err = setns(int(ns.Fd()), nsPath); err != nil {
+			runtime.UnlockOSThread()
+			errc <- err
+			return
+		}
+
+		ferr := fn()
+
+		// A thread that cannot go back stays locked, so that the runtime
+		// ends it with this goroutine instead of reusing it.
+		if err = setns(int(orig.Fd()), "original namespace"); err != nil {
+			errc <- err
+			return
+		}
+
+		runtime.UnlockOSThread()
+		errc <- ferr
+	}()
+	return <-errc
+}
+
+func setns(fd int, name string) error {
+	if _, _, errno := syscall.Syscall(sysSetns, uintptr(fd), syscall.CLONE_NEWNET, 0); errno != 0 {
+		return fmt.Errorf("setns %s: %w", name, errno)
+	}
+	return nil
+}
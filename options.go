@@ -0,0 +1,439 @@
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+var (
+	errUnsupportedPMTUDMode = errors.New("unknown path MTU discovery mode")
+	errInvalidDSCP          = errors.New("DSCP must be between 0 and 63")
+	errPacketConnOption     = errors.New("option is only supported by packet conns")
+	errListenerOption       = errors.New("option is only supported by listeners")
+	errNegativeTimeout      = errors.New("timeouts must not be negative")
+	errNegativeKeepAlive    = errors.New("keepalive idle, interval and count must not be negative")
+)
+
+// Option configures a socket created by NewReusablePortListener or
+// NewReusablePortPacketConn. Options are applied after SO_REUSEPORT is set
+// and before the socket is bound. Options set on a listener are inherited by
+// the connections it accepts.
+type Option func(*config)
+
+type config struct {
+	pmtud   PMTUDMode
+	recvErr bool
+	recvECN bool
+	rxqOvfl bool
+
+	timestamps   bool
+	txTimestamps bool
+
+	fastOpenQueue int
+	fastOpenKey   *FastOpenKey
+	deferAccept   time.Duration
+
+	keepAlive   *KeepAlive
+	userTimeout time.Duration
+
+	congestion    string
+	maxPacingRate uint64
+
+	readBuffer   int
+	writeBuffer  int
+	forceBuffers bool
+
+	dscp    uint8
+	hasDSCP bool
+
+	mark        uint32
+	priority    int
+	hasPriority bool
+
+	device string
+
+	freebind    bool
+	transparent bool
+	recvOrigDst bool
+
+	linger *time.Duration
+
+	busyPoll *BusyPoll
+
+	zeroCopy bool
+
+	exclusive *ExclusiveGroup
+
+	netns string
+}
+
+// packetOnly reports whether cfg holds options that only make sense on
+// UDP sockets.
+func (c *config) packetOnly() bool {
+	return c.pmtud != PMTUDDefault || c.recvErr || c.recvECN || c.rxqOvfl || c.recvOrigDst
+}
+
+// checkTimeouts rejects negative timeouts and keepalive settings, rather
+// than silently ignoring them.
+func (c *config) checkTimeouts() error {
+	if c.deferAccept < 0 || c.userTimeout < 0 {
+		return errNegativeTimeout
+	}
+
+	if ka := c.keepAlive; ka != nil && (ka.Idle < 0 || ka.Interval < 0 || ka.Count < 0) {
+		return errNegativeKeepAlive
+	}
+	return nil
+}
+
+// listenerOnly reports whether cfg holds options that only make sense on
+// TCP listeners.
+func (c *config) listenerOnly() bool {
+	return c.fastOpenQueue != 0 || c.fastOpenKey != nil || c.deferAccept != 0 ||
+		c.keepAlive != nil || c.userTimeout != 0 || c.congestion != "" || c.linger != nil ||
+		c.zeroCopy
+}
+
+func newConfig(opts []Option) *config {
+	cfg := &config{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+func errUnsupportedOption(name string) error {
+	return fmt.Errorf("%s is not supported on %s", name, runtime.GOOS)
+}
+
+// hasConnOptions reports whether cfg holds options that wrapListener must
+// apply to every accepted conn.
+func (c *config) hasConnOptions() bool {
+	return c.keepAlive != nil || c.userTimeout != 0 || c.linger != nil || c.zeroCopy
+}
+
+// PMTUDMode is a Path MTU Discovery mode for UDP sockets.
+type PMTUDMode int
+
+const (
+	// PMTUDDefault leaves the kernel default in place.
+	PMTUDDefault PMTUDMode = iota
+	// PMTUDDont never sets the Don't-Fragment bit.
+	PMTUDDont
+	// PMTUDDo always sets the Don't-Fragment bit and refuses to send
+	// datagrams larger than the known path MTU.
+	PMTUDDo
+	// PMTUDProbe sets the Don't-Fragment bit but ignores the cached path
+	// MTU, which is what PMTU probing (e.g. in QUIC) needs.
+	PMTUDProbe
+)
+
+// WithPathMTUDiscovery sets IP_MTU_DISCOVER (or IPV6_MTU_DISCOVER) on a UDP
+// socket. PMTUDDo and PMTUDProbe also enable IP_RECVERR, so that
+// EMSGSIZE and ICMP "fragmentation needed" errors can be read back with
+// ReadPathMTUError. Linux only.
+func WithPathMTUDiscovery(mode PMTUDMode) Option {
+	return func(c *config) {
+		c.pmtud = mode
+		if mode == PMTUDDo || mode == PMTUDProbe {
+			c.recvErr = true
+		}
+	}
+}
+
+// WithExtendedErrors enables IP_RECVERR (or IPV6_RECVERR) on a UDP socket,
+// so that ICMP errors such as "port unreachable" or "TTL exceeded" are
+// queued on the socket and can be read back with ReadErrQueue. Linux only.
+func WithExtendedErrors() Option {
+	return func(c *config) {
+		c.recvErr = true
+	}
+}
+
+// WithECN enables IP_RECVTOS (or IPV6_RECVTCLASS) on a UDP socket, so that
+// ReadMsg reports the ECN codepoint of every received datagram. Linux only.
+func WithECN() Option {
+	return func(c *config) {
+		c.recvECN = true
+	}
+}
+
+// WithTimestamps enables SO_TIMESTAMPNS and software receive timestamps
+// (SO_TIMESTAMPING) on a socket. They are reported by ReadMsg and
+// ReadTimestamp. Linux only.
+func WithTimestamps() Option {
+	return func(c *config) {
+		c.timestamps = true
+	}
+}
+
+// WithTxTimestamps enables software transmit timestamps (SO_TIMESTAMPING)
+// on a socket. A record is queued on the socket error queue for every
+// send, to be read with ReadErrQueue. Queued records count against the
+// receive buffer, so the error queue must be drained regularly: left
+// alone, it starves normal receives of buffer space and shrinks the TCP
+// receive window. Linux only.
+func WithTxTimestamps() Option {
+	return func(c *config) {
+		c.txTimestamps = true
+	}
+}
+
+// WithDropCounter enables SO_RXQ_OVFL on a UDP socket, so that every
+// received datagram carries the number of datagrams the kernel has dropped
+// on the socket so far. See ControlMessage.Drops and CountDrops. Linux only.
+func WithDropCounter() Option {
+	return func(c *config) {
+		c.rxqOvfl = true
+	}
+}
+
+// WithFastOpen enables TCP Fast Open on a listener by setting TCP_FASTOPEN
+// with the given maximum queue length of pending TFO requests. The server
+// bit of the net.ipv4.tcp_fastopen sysctl must be set as well. Use
+// FastOpened to tell whether an accepted conn carried data in its SYN.
+// Linux only.
+func WithFastOpen(queueLen int) Option {
+	return func(c *config) {
+		c.fastOpenQueue = queueLen
+	}
+}
+
+// WithFastOpenKey installs key as the TCP Fast Open cookie key of a
+// listener (TCP_FASTOPEN_KEY), so that every process in a reuseport group
+// hands out and accepts the same cookies. Linux only.
+func WithFastOpenKey(key FastOpenKey) Option {
+	return func(c *config) {
+		c.fastOpenKey = &key
+	}
+}
+
+// WithDeferAccept sets TCP_DEFER_ACCEPT on a listener, so that Accept only
+// returns connections once the client has sent data, or the timeout has
+// expired. The timeout is rounded up to whole seconds.
+//
+// FreeBSD, NetBSD and DragonFly BSD attach the "dataready" accept filter
+// instead, which waits for data without a timeout; FreeBSD needs the
+// accf_data module loaded for it. Other platforms reject the option.
+func WithDeferAccept(timeout time.Duration) Option {
+	return func(c *config) {
+		c.deferAccept = timeout
+	}
+}
+
+// KeepAlive is a TCP keepalive policy. Zero fields take the kernel defaults
+// (net.ipv4.tcp_keepalive_time, tcp_keepalive_intvl and tcp_keepalive_probes)
+// on the listener and on accepted conns alike.
+type KeepAlive struct {
+	Idle     time.Duration // TCP_KEEPIDLE, rounded up to whole seconds
+	Interval time.Duration // TCP_KEEPINTVL, rounded up to whole seconds
+	Count    int           // TCP_KEEPCNT
+}
+
+// WithKeepAlive enables SO_KEEPALIVE with the given policy on a listener.
+// The policy is set on the listening socket, so the kernel passes it on to
+// accepted sockets, and it is applied again to every conn returned by
+// Accept, since the net package would otherwise override it with its own
+// defaults. Linux only.
+//
+// The listener returned is then not a *net.TCPListener, as its Accept and
+// AcceptTCP methods apply the policy to every conn.
+func WithKeepAlive(ka KeepAlive) Option {
+	return func(c *config) {
+		c.keepAlive = &ka
+	}
+}
+
+// WithUserTimeout sets TCP_USER_TIMEOUT on a listener and the conns it
+// accepts: the time transmitted data may remain unacknowledged before the
+// connection is forcibly closed. Linux only.
+//
+// The listener returned is then not a *net.TCPListener, since its Accept
+// and AcceptTCP methods set the timeout on every conn.
+func WithUserTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.userTimeout = timeout
+	}
+}
+
+// WithCongestionControl sets the TCP congestion control algorithm of a
+// listener and the conns it accepts (TCP_CONGESTION), e.g. "bbr" or
+// "cubic". The name is checked against
+// net.ipv4.tcp_available_congestion_control. Linux only.
+func WithCongestionControl(name string) Option {
+	return func(c *config) {
+		c.congestion = name
+	}
+}
+
+// WithMaxPacingRate caps the pacing rate of a socket, in bytes per second
+// (SO_MAX_PACING_RATE). Conns accepted from a listener inherit the cap.
+// Linux only.
+func WithMaxPacingRate(bytesPerSecond uint64) Option {
+	return func(c *config) {
+		c.maxPacingRate = bytesPerSecond
+	}
+}
+
+// WithReadBuffer sets the receive buffer size of a socket (SO_RCVBUF).
+// If the kernel grants less than bytes, creating the socket fails with a
+// *BufferSizeError.
+func WithReadBuffer(bytes int) Option {
+	return func(c *config) {
+		c.readBuffer = bytes
+	}
+}
+
+// WithWriteBuffer sets the send buffer size of a socket (SO_SNDBUF).
+// If the kernel grants less than bytes, creating the socket fails with a
+// *BufferSizeError.
+func WithWriteBuffer(bytes int) Option {
+	return func(c *config) {
+		c.writeBuffer = bytes
+	}
+}
+
+// WithForcedBuffers makes WithReadBuffer and WithWriteBuffer use
+// SO_RCVBUFFORCE and SO_SNDBUFFORCE, which ignore net.core.rmem_max and
+// net.core.wmem_max. Without CAP_NET_ADMIN the regular options are used.
+// Only Linux has forced buffers; elsewhere this option has no effect.
+func WithForcedBuffers() Option {
+	return func(c *config) {
+		c.forceBuffers = true
+	}
+}
+
+// WithDSCP marks the traffic of a socket with the given Differentiated
+// Services codepoint by setting IP_TOS (or IPV6_TCLASS) to dscp<<2. Conns
+// accepted from a listener inherit the marking. Datagrams can be marked
+// individually with WriteMsg on Linux.
+func WithDSCP(dscp uint8) Option {
+	return func(c *config) {
+		c.dscp = dscp
+		c.hasDSCP = true
+	}
+}
+
+// WithMark sets the fwmark of a socket (SO_MARK), for use by policy
+// routing and netfilter. Conns accepted from a listener inherit the mark.
+// Setting a mark requires CAP_NET_ADMIN. Linux only.
+func WithMark(mark uint32) Option {
+	return func(c *config) {
+		c.mark = mark
+	}
+}
+
+// WithPriority sets the queueing priority of the packets sent by a socket
+// (SO_PRIORITY). Priorities above 6 require CAP_NET_ADMIN. Linux only.
+func WithPriority(priority int) Option {
+	return func(c *config) {
+		c.priority = priority
+		c.hasPriority = true
+	}
+}
+
+// WithDevice binds a socket to a network device or a VRF master device
+// (SO_BINDTODEVICE) before it is bound to its address. For IPv4 the device
+// can also be given in the address, as in "10.0.0.1%eth0:80". Linux only.
+func WithDevice(name string) Option {
+	return func(c *config) {
+		c.device = name
+	}
+}
+
+// WithFreebind sets IP_FREEBIND (or IPV6_FREEBIND) on a socket, so that it
+// can be bound to an address that is not configured on the host yet, e.g.
+// a VIP during failover. Linux only.
+func WithFreebind() Option {
+	return func(c *config) {
+		c.freebind = true
+	}
+}
+
+// WithTransparent sets IP_TRANSPARENT (or IPV6_TRANSPARENT) on a socket, as
+// needed by transparent proxies using TPROXY. It requires CAP_NET_ADMIN.
+// Linux only.
+func WithTransparent() Option {
+	return func(c *config) {
+		c.transparent = true
+	}
+}
+
+// WithOriginalDestination enables IP_RECVORIGDSTADDR (or
+// IPV6_RECVORIGDSTADDR) on a UDP socket, so that ReadMsg reports the
+// original destination of every datagram, which differs from the local
+// address of the socket for datagrams redirected by TPROXY. Linux only.
+func WithOriginalDestination() Option {
+	return func(c *config) {
+		c.recvOrigDst = true
+	}
+}
+
+// WithLinger sets SO_LINGER on a listener and the conns it accepts: Close
+// blocks for up to timeout while unsent data is delivered. A zero timeout
+// makes Close discard unsent data and reset the connection instead of
+// leaving it in TIME_WAIT. The timeout is rounded up to whole seconds.
+//
+// On Linux, the listener returned is then not a *net.TCPListener, since its
+// Accept and AcceptTCP methods set SO_LINGER on every conn.
+func WithLinger(timeout time.Duration) Option {
+	return func(c *config) {
+		c.linger = &timeout
+	}
+}
+
+// BusyPoll is a low-latency busy polling configuration.
+type BusyPoll struct {
+	// Timeout is how long a blocking read busy polls the device queue
+	// before sleeping (SO_BUSY_POLL), rounded down to microseconds.
+	Timeout time.Duration
+
+	// Prefer asks the kernel to prefer busy polling over softirq
+	// processing (SO_PREFER_BUSY_POLL).
+	Prefer bool
+
+	// Budget is the number of packets processed per busy poll
+	// (SO_BUSY_POLL_BUDGET). Zero keeps the kernel default.
+	Budget int
+}
+
+// WithBusyPoll enables busy polling on a socket. A Timeout above
+// net.core.busy_read, Prefer and a raised Budget all require
+// CAP_NET_ADMIN. Linux only.
+func WithBusyPoll(bp BusyPoll) Option {
+	return func(c *config) {
+		c.busyPoll = &bp
+	}
+}
+
+// WithZeroCopy makes a listener return every accepted conn as a
+// *ZeroCopyConn, which sends large writes with MSG_ZEROCOPY. Linux only.
+//
+// The listener returned is then not a *net.TCPListener. Its AcceptTCP
+// method returns plain *net.TCPConn values, which send without
+// MSG_ZEROCOPY.
+func WithZeroCopy() Option {
+	return func(c *config) {
+		c.zeroCopy = true
+	}
+}
+
+// WithExclusiveGroup guards against other processes joining the reuseport
+// group with sockets on the same address, or a more specific one, and
+// stealing part of its traffic. Creating the socket fails with a
+// *GroupIntruderError when unexpected sockets are already there, and later
+// checks report new ones to g.OnIntruder. Sockets are found through
+// sock_diag and /proc; see Siblings. Linux only.
+func WithExclusiveGroup(g ExclusiveGroup) Option {
+	return func(c *config) {
+		c.exclusive = &g
+	}
+}
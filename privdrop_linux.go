@@ -0,0 +1,138 @@
+// +build linux
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var errDropToRoot = errors.New("cannot drop privileges to uid or gid 0")
+
+// ListenSpec describes a listener or packet conn for ListenThenDrop.
+type ListenSpec struct {
+	Net     string // "tcp", "tcp4", "tcp6", "udp", "udp4" or "udp6"
+	Addr    string
+	Options []Option
+}
+
+// ListenThenDrop opens a listener or packet conn for every spec, so that
+// privileged ports can be bound, and then switches the real, effective and
+// saved IDs of the process to uid and gid, and its supplementary groups to
+// none. Listeners and packet conns are returned in the order of their
+// specs.
+//
+// Neither uid nor gid may be 0. It verifies afterwards that the old IDs and
+// capabilities are gone, and panics if root can be regained, as the process
+// must not go on serving then (CERT POS37-C). If anything else fails,
+// everything opened is closed again; the process may be left with its
+// credentials partly changed then and should exit.
+func ListenThenDrop(specs []ListenSpec, uid, gid int) (listeners []net.Listener, conns []net.PacketConn, err error) {
+	if uid == 0 || gid == 0 {
+		return nil, nil, errDropToRoot
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, l := range listeners {
+			l.Close()
+		}
+		for _, c := range conns {
+			c.Close()
+		}
+		listeners, conns = nil, nil
+	}()
+
+	for _, spec := range specs {
+		switch spec.Net {
+		case "tcp", "tcp4", "tcp6":
+			l, err := NewReusablePortListener(spec.Net, spec.Addr, spec.Options...)
+			if err != nil {
+				return listeners, conns, err
+			}
+			listeners = append(listeners, l)
+		case "udp", "udp4", "udp6":
+			c, err := NewReusablePortPacketConn(spec.Net, spec.Addr, spec.Options...)
+			if err != nil {
+				return listeners, conns, err
+			}
+			conns = append(conns, c)
+		default:
+			return listeners, conns, opError("", spec.Net, spec.Addr, nil, net.UnknownNetworkError(spec.Net))
+		}
+	}
+
+	// Groups go first, since changing them takes the privileges that
+	// changing the uid drops.
+	if err = syscall.Setgroups([]int{}); err != nil {
+		return listeners, conns, fmt.Errorf("setgroups: %w", err)
+	}
+	if err = syscall.Setresgid(gid, gid, gid); err != nil {
+		return listeners, conns, fmt.Errorf("setresgid %d: %w", gid, err)
+	}
+	if err = syscall.Setresuid(uid, uid, uid); err != nil {
+		return listeners, conns, fmt.Errorf("setresuid %d: %w", uid, err)
+	}
+
+	if err = verifyDropped(uid, gid); err != nil {
+		return listeners, conns, err
+	}
+
+	if syscall.Setuid(0) == nil || syscall.Setgid(0) == nil {
+		panic("reuseport: privileges not dropped: root could be regained")
+	}
+	return listeners, conns, nil
+}
+
+// verifyDropped checks that the process runs with uid and gid only and holds
+// no capabilities.
+func verifyDropped(uid, gid int) error {
+	b, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return err
+	}
+
+	want := map[string]string{
+		"Uid":    strings.Repeat(strconv.Itoa(uid)+" ", 4),
+		"Gid":    strings.Repeat(strconv.Itoa(gid)+" ", 4),
+		"Groups": "",
+		"CapPrm": "0000000000000000 ",
+		"CapEff": "0000000000000000 ",
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+
+		name := line[:i]
+		w, ok := want[name]
+		if !ok {
+			continue
+		}
+
+		// Normalize the tab and space separated fields.
+		got := ""
+		for _, f := range strings.Fields(line[i+1:]) {
+			got += f + " "
+		}
+		if got != w {
+			return fmt.Errorf("privileges not dropped: %s is %q", name, strings.TrimSpace(got))
+		}
+		delete(want, name)
+	}
+	return nil
+}
@@ -11,16 +11,59 @@
 package reuseport
 
 import (
-	"errors"
 	"fmt"
 	"net"
-	"os"
+	"strings"
 	"syscall"
+	"time"
 )
 
-const fileNameTemplate = "reuseport.%d.%s.%s"
+// Error records the stage at which creating a listener or packet conn
+// failed, such as "socket", "setsockopt:SO_REUSEPORT", "setsockopt:TCP_KEEPCNT",
+// "bind", "listen", "fileconn" or "groupcheck". A failed socket option is
+// named after the Op's colon; Op is plain "setsockopt" only when the options
+// were rejected before any was set. NewReusablePortListener and
+// NewReusablePortPacketConn return it as the Err of a *net.OpError, and it
+// unwraps to the underlying error, usually a syscall.Errno.
+type Error struct {
+	Op   string
+	Net  string
+	Addr string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// opError wraps err in a *net.OpError for the listen call on proto and
+// addr. When op is not empty, it names the failed stage, and err is
+// wrapped in an Error first, unless it is one already, as returned by
+// sockoptError, whose more specific Op is kept.
+func opError(op, proto, addr string, sa syscall.Sockaddr, err error) error {
+	if op != "" {
+		if e, ok := err.(*Error); ok {
+			e.Net, e.Addr = proto, addr
+		} else {
+			err = &Error{Op: op, Net: proto, Addr: addr, Err: err}
+		}
+	}
 
-var errUnsupportedProtocol = errors.New("only tcp, tcp4, tcp6, udp, udp4, udp6 are supported")
+	e := &net.OpError{Op: "listen", Net: proto, Err: err}
+	if udp := sockaddrToUDPAddr(sa); udp != nil {
+		if strings.HasPrefix(proto, "tcp") {
+			e.Addr = &net.TCPAddr{IP: udp.IP, Port: udp.Port, Zone: udp.Zone}
+		} else {
+			e.Addr = udp
+		}
+	}
+	return e
+}
 
 // getSockaddr parses protocol and address and returns implementor
 // of syscall.Sockaddr: syscall.SockaddrInet4 or syscall.SockaddrInet6.
@@ -31,20 +74,137 @@ func getSockaddr(proto, addr string) (sa syscall.Sockaddr, soType int, err error
 	case "udp", "udp4", "udp6":
 		return getUDPSockaddr(proto, addr)
 	default:
-		return nil, -1, errUnsupportedProtocol
+		return nil, -1, net.UnknownNetworkError(proto)
+	}
+}
+
+// splitDevice strips a "%dev" suffix from the host part of an IPv4 address
+// like "10.0.0.1%eth0:80" and returns the address without it and the device
+// name. IPv6 zones are left alone, since getTCPSockaddr and getUDPSockaddr
+// turn them into scope IDs.
+func splitDevice(addr string) (string, string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, ""
 	}
+
+	i := strings.LastIndexByte(host, '%')
+	if i < 0 || strings.Contains(host, ":") {
+		return addr, ""
+	}
+
+	return net.JoinHostPort(host[:i], port), host[i+1:]
 }
 
-func getSocketFileName(proto, addr string) string {
-	return fmt.Sprintf(fileNameTemplate, os.Getpid(), proto, addr)
+// resolveDevice returns addr without its device suffix, and records the
+// device in cfg for SO_BINDTODEVICE.
+func resolveDevice(addr string, cfg *config) (string, error) {
+	addr, device := splitDevice(addr)
+	if device == "" {
+		return addr, nil
+	}
+
+	if cfg.device != "" && cfg.device != device {
+		return "", fmt.Errorf("address is scoped to %q, but WithDevice asks for %q", device, cfg.device)
+	}
+
+	cfg.device = device
+	return addr, nil
 }
 
 // Listen function is an alias for NewReusablePortListener.
-func Listen(proto, addr string) (l net.Listener, err error) {
-	return NewReusablePortListener(proto, addr)
+func Listen(proto, addr string, opts ...Option) (l net.Listener, err error) {
+	return NewReusablePortListener(proto, addr, opts...)
 }
 
 // ListenPacket is an alias for NewReusablePortPacketConn.
-func ListenPacket(proto, addr string) (l net.PacketConn, err error) {
-	return NewReusablePortPacketConn(proto, addr)
+func ListenPacket(proto, addr string, opts ...Option) (l net.PacketConn, err error) {
+	return NewReusablePortPacketConn(proto, addr, opts...)
+}
+
+// control runs fn with the file descriptor underlying c.
+func control(c syscall.Conn, fn func(fd int) error) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ferr error
+	if err = rc.Control(func(fd uintptr) {
+		ferr = fn(int(fd))
+	}); err != nil {
+		return err
+	}
+	return ferr
+}
+
+func socketFamily(fd int) (int, error) {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return -1, err
+	}
+
+	switch sa.(type) {
+	case *syscall.SockaddrInet4:
+		return syscall.AF_INET, nil
+	case *syscall.SockaddrInet6:
+		return syscall.AF_INET6, nil
+	}
+	return -1, syscall.EAFNOSUPPORT
+}
+
+// sockoptError records that setting the socket option name failed with err.
+// opError fills in the network and address.
+func sockoptError(name string, err error) error {
+	return &Error{Op: "setsockopt:" + name, Err: err}
+}
+
+// ipOptionName returns v4 or v6, the names of an IPPROTO_IP option and its
+// IPPROTO_IPV6 counterpart, depending on the address family of the socket.
+func ipOptionName(family int, v4, v6 string) string {
+	if family == syscall.AF_INET6 {
+		return v6
+	}
+	return v4
+}
+
+// setIPOption sets the IPPROTO_IP option v4 or the IPPROTO_IPV6 option v6,
+// depending on the address family of the socket.
+func setIPOption(fd, family, v4, v6, value int) error {
+	if family == syscall.AF_INET6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, v6, value)
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, v4, value)
+}
+
+// setDSCP sets the DSCP bits of IP_TOS or IPV6_TCLASS. IPv6 sockets get
+// IP_TOS as well, for the IPv4 traffic they carry in dual-stack mode, where
+// the platform allows it.
+func setDSCP(fd, family int, dscp uint8) error {
+	if dscp > 63 {
+		return errInvalidDSCP
+	}
+
+	tos := int(dscp) << 2
+	if err := setIPOption(fd, family, syscall.IP_TOS, syscall.IPV6_TCLASS, tos); err != nil {
+		return sockoptError(ipOptionName(family, "IP_TOS", "IPV6_TCLASS"), err)
+	}
+
+	if family == syscall.AF_INET6 {
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	}
+	return nil
+}
+
+// setLinger enables SO_LINGER with the given timeout, rounded up to whole
+// seconds.
+func setLinger(fd int, timeout time.Duration) error {
+	l := &syscall.Linger{
+		Onoff:  1,
+		Linger: int32((timeout + time.Second - 1) / time.Second),
+	}
+	if err := syscall.SetsockoptLinger(fd, syscall.SOL_SOCKET, syscall.SO_LINGER, l); err != nil {
+		return sockoptError("SO_LINGER", err)
+	}
+	return nil
 }
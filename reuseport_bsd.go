@@ -15,6 +15,25 @@ import (
 
 var reusePort = syscall.SO_REUSEPORT
 
+// The BSDs have no privileged counterparts of SO_RCVBUF and SO_SNDBUF, and
+// report buffer sizes as set.
+const (
+	soRcvbufForce  = -1
+	soSndbufForce  = -1
+	bufferOverhead = 1
+)
+
+// socketCookie returns zero, since the BSDs have no SO_COOKIE.
+func socketCookie(fd int) (uint64, error) {
+	return 0, nil
+}
+
+// bindError returns err as it is, since there is no sock_diag to find the
+// owner of an address in use.
+func bindError(proto, addr, device string, err error) error {
+	return err
+}
+
 func maxListenerBacklog() int {
 	var (
 		n   uint32
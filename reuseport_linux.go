@@ -10,13 +10,40 @@ package reuseport
 
 import (
 	"bufio"
+	"encoding/binary"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
 	"syscall"
+	"unsafe"
 )
 
-var reusePort = 0x0F
+var (
+	reusePort    = 0x0F
+	nativeEndian = getNativeEndian()
+)
+
+const (
+	soRcvbufForce = syscall.SO_RCVBUFFORCE
+	soSndbufForce = syscall.SO_SNDBUFFORCE
+
+	// Linux doubles SO_RCVBUF and SO_SNDBUF to make room for its own
+	// bookkeeping.
+	bufferOverhead = 2
+
+	soCookie = 0x39 // SO_COOKIE
+)
+
+// getNativeEndian reports the byte order of the host, which is the order
+// the kernel uses for socket options and control messages.
+func getNativeEndian() binary.ByteOrder {
+	var x uint16 = 1
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
 
 func maxListenerBacklog() int {
 	fd, err := os.Open("/proc/sys/net/core/somaxconn")
@@ -50,3 +77,53 @@ func maxListenerBacklog() int {
 
 	return n
 }
+
+// availableCongestionControl returns the TCP congestion control algorithms
+// that are currently available to sockets.
+func availableCongestionControl() ([]string, error) {
+	b, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_available_congestion_control")
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(string(b)), nil
+}
+
+// readSysctlInt reads an integer sysctl such as "net/core/busy_read".
+func readSysctlInt(name string) (int, error) {
+	b, err := ioutil.ReadFile("/proc/sys/" + name)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// socketCookie returns the SO_COOKIE of a socket. Linux 4.12 and later
+// have it; older kernels report zero.
+func socketCookie(fd int) (uint64, error) {
+	var b [8]byte
+	if _, err := getsockopt(fd, syscall.SOL_SOCKET, soCookie, b[:]); err != nil {
+		if err == syscall.ENOPROTOOPT {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return nativeEndian.Uint64(b[:]), nil
+}
+
+// getsockopt reads a socket option of arbitrary size into b and returns the
+// number of bytes the kernel wrote.
+func getsockopt(fd, level, opt int, b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, syscall.EINVAL
+	}
+
+	n := uint32(len(b))
+	_, _, e := syscall.Syscall6(sysGetsockopt, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(unsafe.Pointer(&b[0])), uintptr(unsafe.Pointer(&n)), 0)
+	if e != 0 {
+		return 0, e
+	}
+	return int(n), nil
+}
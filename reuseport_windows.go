@@ -10,10 +10,18 @@ package reuseport
 
 import "net"
 
-func NewReusablePortListener(proto, addr string) (net.Listener, error) {
+func NewReusablePortListener(proto, addr string, opts ...Option) (net.Listener, error) {
+	if len(opts) > 0 {
+		return nil, errUnsupportedOption("socket options")
+	}
+
 	return net.Listen(proto, addr)
 }
 
-func NewReusablePortPacketConn(proto, addr string) (net.PacketConn, error) {
+func NewReusablePortPacketConn(proto, addr string, opts ...Option) (net.PacketConn, error) {
+	if len(opts) > 0 {
+		return nil, errUnsupportedOption("socket options")
+	}
+
 	return net.ListenPacket(proto, addr)
 }
@@ -0,0 +1,162 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"net"
+	"syscall"
+)
+
+// setPacketConnOptions applies cfg to a UDP socket of the given address
+// family before it is bound.
+func setPacketConnOptions(fd, family int, cfg *config) error {
+	if cfg.listenerOnly() {
+		return errListenerOption
+	}
+
+	if cfg.pmtud != PMTUDDefault {
+		return errUnsupportedOption("path MTU discovery")
+	}
+
+	if cfg.recvErr {
+		return errUnsupportedOption("IP_RECVERR")
+	}
+
+	if cfg.recvECN {
+		return errUnsupportedOption("ECN")
+	}
+
+	if cfg.rxqOvfl {
+		return errUnsupportedOption("SO_RXQ_OVFL")
+	}
+
+	if cfg.recvOrigDst {
+		return errUnsupportedOption("IP_RECVORIGDSTADDR")
+	}
+
+	return setSocketOptions(fd, family, false, cfg)
+}
+
+// setListenerOptions applies cfg to a TCP socket of the given address
+// family before it is bound.
+func setListenerOptions(fd, family int, cfg *config) error {
+	if cfg.packetOnly() {
+		return errPacketConnOption
+	}
+
+	if cfg.fastOpenQueue != 0 || cfg.fastOpenKey != nil {
+		return errUnsupportedOption("TCP Fast Open")
+	}
+
+	// WithDeferAccept is applied by setListeningOptions.
+	if err := cfg.checkTimeouts(); err != nil {
+		return err
+	}
+
+	if cfg.keepAlive != nil || cfg.userTimeout != 0 {
+		return errUnsupportedOption("keepalive policy")
+	}
+
+	if cfg.congestion != "" {
+		return errUnsupportedOption("TCP_CONGESTION")
+	}
+
+	if cfg.zeroCopy {
+		return errUnsupportedOption("MSG_ZEROCOPY")
+	}
+
+	// Accepted sockets inherit SO_LINGER from the listening socket.
+	if cfg.linger != nil {
+		if err := setLinger(fd, *cfg.linger); err != nil {
+			return err
+		}
+	}
+
+	return setSocketOptions(fd, family, true, cfg)
+}
+
+// setSocketOptions applies the parts of cfg that are common to listeners
+// and packet conns.
+func setSocketOptions(fd, family int, stream bool, cfg *config) error {
+	if cfg.device != "" {
+		return errUnsupportedOption("SO_BINDTODEVICE")
+	}
+
+	if cfg.exclusive != nil {
+		return errUnsupportedOption("exclusive groups")
+	}
+
+	if cfg.freebind {
+		return errUnsupportedOption("IP_FREEBIND")
+	}
+
+	if cfg.transparent {
+		return errUnsupportedOption("IP_TRANSPARENT")
+	}
+
+	if cfg.timestamps || cfg.txTimestamps {
+		return errUnsupportedOption("SO_TIMESTAMPING")
+	}
+
+	if cfg.maxPacingRate != 0 {
+		return errUnsupportedOption("SO_MAX_PACING_RATE")
+	}
+
+	if cfg.mark != 0 {
+		return errUnsupportedOption("SO_MARK")
+	}
+
+	if cfg.hasPriority {
+		return errUnsupportedOption("SO_PRIORITY")
+	}
+
+	if cfg.busyPoll != nil {
+		return errUnsupportedOption("SO_BUSY_POLL")
+	}
+
+	if cfg.readBuffer > 0 {
+		if err := setBufferSize(fd, "SO_RCVBUF", syscall.SO_RCVBUF, soRcvbufForce, cfg.readBuffer, cfg.forceBuffers); err != nil {
+			return err
+		}
+	}
+
+	if cfg.writeBuffer > 0 {
+		if err := setBufferSize(fd, "SO_SNDBUF", syscall.SO_SNDBUF, soSndbufForce, cfg.writeBuffer, cfg.forceBuffers); err != nil {
+			return err
+		}
+	}
+
+	if cfg.hasDSCP {
+		if err := setDSCP(fd, family, cfg.dscp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setListeningOptions applies the parts of cfg that need a listening
+// socket: the accept filter of WithDeferAccept.
+func setListeningOptions(fd int, cfg *config) error {
+	if cfg.deferAccept > 0 {
+		return setAcceptFilter(fd)
+	}
+	return nil
+}
+
+// wrapListener returns l as is, or wrapped so that Accept applies the conn
+// options in cfg.
+func wrapListener(l net.Listener, cfg *config) net.Listener {
+	return l
+}
+
+// guardGroup has nothing to do, since WithExclusiveGroup is rejected.
+func guardGroup(c syscall.Conn, addr net.Addr, cfg *config) error {
+	return nil
+}
@@ -0,0 +1,487 @@
+// +build linux
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	tcpUserTimeout  = 0x12 // TCP_USER_TIMEOUT
+	soMaxPacingRate = 0x2f // SO_MAX_PACING_RATE
+
+	ipv6RecvOrigDstAddr = 0x4a // IPV6_RECVORIGDSTADDR
+	ipv6Transparent     = 0x4b // IPV6_TRANSPARENT
+	ipv6Freebind        = 0x4e // IPV6_FREEBIND
+
+	soBusyPoll       = 0x2e // SO_BUSY_POLL
+	soPreferBusyPoll = 0x45 // SO_PREFER_BUSY_POLL
+	soBusyPollBudget = 0x46 // SO_BUSY_POLL_BUDGET
+)
+
+// Flags for SO_TIMESTAMPING from linux/net_tstamp.h.
+const (
+	sofTimestampingTxSoftware = 1 << 1
+	sofTimestampingRxSoftware = 1 << 3
+	sofTimestampingSoftware   = 1 << 4
+	sofTimestampingOptID      = 1 << 7
+	sofTimestampingOptTSOnly  = 1 << 11
+
+	rxTimestampingFlags = sofTimestampingRxSoftware | sofTimestampingSoftware
+	txTimestampingFlags = sofTimestampingTxSoftware | sofTimestampingSoftware | sofTimestampingOptTSOnly
+)
+
+var pmtudModes = map[PMTUDMode]int{
+	PMTUDDont:  syscall.IP_PMTUDISC_DONT,
+	PMTUDDo:    syscall.IP_PMTUDISC_DO,
+	PMTUDProbe: syscall.IP_PMTUDISC_PROBE,
+}
+
+// setPacketConnOptions applies cfg to a UDP socket of the given address
+// family before it is bound.
+func setPacketConnOptions(fd, family int, cfg *config) error {
+	if cfg.listenerOnly() {
+		return errListenerOption
+	}
+
+	if cfg.pmtud != PMTUDDefault {
+		mode, ok := pmtudModes[cfg.pmtud]
+		if !ok {
+			return errUnsupportedPMTUDMode
+		}
+
+		if err := setIPOption(fd, family, syscall.IP_MTU_DISCOVER, syscall.IPV6_MTU_DISCOVER, mode); err != nil {
+			return sockoptError(ipOptionName(family, "IP_MTU_DISCOVER", "IPV6_MTU_DISCOVER"), err)
+		}
+
+		// IPv4 datagrams sent from a dual-stack socket follow
+		// IP_MTU_DISCOVER. The IPv4 and IPv6 modes share their values.
+		if family == syscall.AF_INET6 {
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, mode); err != nil {
+				return sockoptError("IP_MTU_DISCOVER", err)
+			}
+		}
+	}
+
+	if cfg.recvErr {
+		if err := setIPOption(fd, family, syscall.IP_RECVERR, syscall.IPV6_RECVERR, 1); err != nil {
+			return sockoptError(ipOptionName(family, "IP_RECVERR", "IPV6_RECVERR"), err)
+		}
+
+		// Errors for IPv4 peers of a dual-stack socket are queued with
+		// IP_RECVERR.
+		if family == syscall.AF_INET6 {
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_RECVERR, 1); err != nil {
+				return sockoptError("IP_RECVERR", err)
+			}
+		}
+	}
+
+	if cfg.recvECN {
+		if err := setIPOption(fd, family, syscall.IP_RECVTOS, syscall.IPV6_RECVTCLASS, 1); err != nil {
+			return sockoptError(ipOptionName(family, "IP_RECVTOS", "IPV6_RECVTCLASS"), err)
+		}
+
+		// IPv4 datagrams received on a dual-stack socket carry IP_TOS.
+		if family == syscall.AF_INET6 {
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1); err != nil {
+				return sockoptError("IP_RECVTOS", err)
+			}
+		}
+	}
+
+	if cfg.rxqOvfl {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RXQ_OVFL, 1); err != nil {
+			return sockoptError("SO_RXQ_OVFL", err)
+		}
+	}
+
+	if cfg.recvOrigDst {
+		if err := setIPOption(fd, family, syscall.IP_RECVORIGDSTADDR, ipv6RecvOrigDstAddr, 1); err != nil {
+			return sockoptError(ipOptionName(family, "IP_RECVORIGDSTADDR", "IPV6_RECVORIGDSTADDR"), err)
+		}
+
+		// IPv4 datagrams received on a dual-stack socket carry
+		// IP_ORIGDSTADDR.
+		if family == syscall.AF_INET6 {
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_RECVORIGDSTADDR, 1); err != nil {
+				return sockoptError("IP_RECVORIGDSTADDR", err)
+			}
+		}
+	}
+
+	return setSocketOptions(fd, family, false, cfg)
+}
+
+// setListenerOptions applies cfg to a TCP socket of the given address
+// family before it is bound.
+func setListenerOptions(fd, family int, cfg *config) error {
+	if cfg.packetOnly() {
+		return errPacketConnOption
+	}
+
+	if err := cfg.checkTimeouts(); err != nil {
+		return err
+	}
+
+	if cfg.fastOpenQueue != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpen, cfg.fastOpenQueue); err != nil {
+			return sockoptError("TCP_FASTOPEN", err)
+		}
+	}
+
+	if cfg.fastOpenKey != nil {
+		if err := syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, tcpFastOpenKey, string(cfg.fastOpenKey[:])); err != nil {
+			return sockoptError("TCP_FASTOPEN_KEY", err)
+		}
+	}
+
+	if cfg.deferAccept > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, roundSeconds(cfg.deferAccept)); err != nil {
+			return sockoptError("TCP_DEFER_ACCEPT", err)
+		}
+	}
+
+	if cfg.congestion != "" {
+		if err := setCongestionControl(fd, cfg.congestion); err != nil {
+			return sockoptError("TCP_CONGESTION", err)
+		}
+	}
+
+	// The net package sets its own keepalive defaults on accepted conns,
+	// so the kernel defaults are taken from the listening socket for
+	// setConnOptions to restore. cfg.keepAlive is replaced, not modified,
+	// since the Option holds on to it.
+	if cfg.keepAlive != nil {
+		ka, err := keepAliveDefaults(fd, *cfg.keepAlive)
+		if err != nil {
+			return err
+		}
+		cfg.keepAlive = &ka
+	}
+
+	if err := setConnOptions(fd, cfg); err != nil {
+		return err
+	}
+
+	return setSocketOptions(fd, family, true, cfg)
+}
+
+// setListeningOptions applies the parts of cfg that need a listening
+// socket. There are none on Linux.
+func setListeningOptions(fd int, cfg *config) error {
+	return nil
+}
+
+// setConnOptions applies the parts of cfg that are inherited by accepted
+// conns, either to a listening socket or to a conn returned by Accept.
+func setConnOptions(fd int, cfg *config) error {
+	if ka := cfg.keepAlive; ka != nil {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+			return sockoptError("SO_KEEPALIVE", err)
+		}
+
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, roundSeconds(ka.Idle)); err != nil {
+			return sockoptError("TCP_KEEPIDLE", err)
+		}
+
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, roundSeconds(ka.Interval)); err != nil {
+			return sockoptError("TCP_KEEPINTVL", err)
+		}
+
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, ka.Count); err != nil {
+			return sockoptError("TCP_KEEPCNT", err)
+		}
+	}
+
+	if cfg.userTimeout > 0 {
+		ms := int(cfg.userTimeout / time.Millisecond)
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpUserTimeout, ms); err != nil {
+			return sockoptError("TCP_USER_TIMEOUT", err)
+		}
+	}
+
+	if cfg.linger != nil {
+		if err := setLinger(fd, *cfg.linger); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// keepAliveDefaults fills the zero fields of ka with the values of fd, a
+// socket fresh from the kernel.
+func keepAliveDefaults(fd int, ka KeepAlive) (KeepAlive, error) {
+	if ka.Idle == 0 {
+		v, err := syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		if err != nil {
+			return ka, &Error{Op: "getsockopt:TCP_KEEPIDLE", Err: err}
+		}
+		ka.Idle = time.Duration(v) * time.Second
+	}
+
+	if ka.Interval == 0 {
+		v, err := syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+		if err != nil {
+			return ka, &Error{Op: "getsockopt:TCP_KEEPINTVL", Err: err}
+		}
+		ka.Interval = time.Duration(v) * time.Second
+	}
+
+	if ka.Count == 0 {
+		v, err := syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT)
+		if err != nil {
+			return ka, &Error{Op: "getsockopt:TCP_KEEPCNT", Err: err}
+		}
+		ka.Count = v
+	}
+	return ka, nil
+}
+
+// wrapListener returns l as is, or wrapped so that Accept applies the conn
+// options in cfg.
+func wrapListener(l net.Listener, cfg *config) net.Listener {
+	tl, ok := l.(*net.TCPListener)
+	if !ok || !cfg.hasConnOptions() {
+		return l
+	}
+
+	return &optionListener{TCPListener: tl, cfg: cfg}
+}
+
+// optionListener applies per-conn options to every conn it accepts. It
+// takes the place of the *net.TCPListener it embeds, whose other methods,
+// such as SetDeadline and File, it keeps.
+type optionListener struct {
+	*net.TCPListener
+	cfg *config
+}
+
+// Accept implements net.Listener.
+func (l *optionListener) Accept() (net.Conn, error) {
+	c, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+
+	if l.cfg.zeroCopy {
+		zc, err := NewZeroCopyConn(c)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return zc, nil
+	}
+
+	return c, nil
+}
+
+// AcceptTCP is like the method of *net.TCPListener, but applies the conn
+// options. Conns are never wrapped in a *ZeroCopyConn here, as Accept does
+// WithZeroCopy.
+func (l *optionListener) AcceptTCP() (*net.TCPConn, error) {
+	c, err := l.TCPListener.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = control(c, func(fd int) error {
+		return setConnOptions(fd, l.cfg)
+	}); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// setCongestionControl sets TCP_CONGESTION after checking that the kernel
+// offers the requested algorithm.
+func setCongestionControl(fd int, name string) error {
+	available, err := availableCongestionControl()
+	if err != nil {
+		return err
+	}
+
+	for _, a := range available {
+		if a == name {
+			return syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, name)
+		}
+	}
+
+	return fmt.Errorf("congestion control %q is not available (net.ipv4.tcp_available_congestion_control: %s)",
+		name, strings.Join(available, " "))
+}
+
+func roundSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// setSocketOptions applies the parts of cfg that are common to listeners
+// and packet conns.
+func setSocketOptions(fd, family int, stream bool, cfg *config) error {
+	if cfg.device != "" {
+		if err := syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, cfg.device); err != nil {
+			return sockoptError("SO_BINDTODEVICE", fmt.Errorf("%s: %w", cfg.device, err))
+		}
+	}
+
+	if cfg.freebind {
+		if err := setIPOption(fd, family, syscall.IP_FREEBIND, ipv6Freebind, 1); err != nil {
+			return sockoptError(ipOptionName(family, "IP_FREEBIND", "IPV6_FREEBIND"), err)
+		}
+	}
+
+	if cfg.transparent {
+		level, opt, name := syscall.IPPROTO_IP, syscall.IP_TRANSPARENT, "IP_TRANSPARENT"
+		if family == syscall.AF_INET6 {
+			level, opt, name = syscall.IPPROTO_IPV6, ipv6Transparent, "IPV6_TRANSPARENT"
+		}
+
+		if err := setPrivilegedOption(fd, name, level, opt, 1); err != nil {
+			return err
+		}
+	}
+
+	if cfg.timestamps {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1); err != nil {
+			return sockoptError("SO_TIMESTAMPNS", err)
+		}
+	}
+
+	if cfg.timestamps || cfg.txTimestamps {
+		var flags int
+		if cfg.timestamps {
+			flags |= rxTimestampingFlags
+		}
+		if cfg.txTimestamps {
+			flags |= txTimestampingFlags
+
+			// The kernel refuses SOF_TIMESTAMPING_OPT_ID on TCP sockets
+			// that are not connected yet, so listeners go without it.
+			if !stream {
+				flags |= sofTimestampingOptID
+			}
+		}
+
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, flags); err != nil {
+			return sockoptError("SO_TIMESTAMPING", err)
+		}
+	}
+
+	if cfg.maxPacingRate > 0 {
+		if err := setMaxPacingRate(fd, cfg.maxPacingRate); err != nil {
+			return sockoptError("SO_MAX_PACING_RATE", err)
+		}
+	}
+
+	if cfg.readBuffer > 0 {
+		if err := setBufferSize(fd, "SO_RCVBUF", syscall.SO_RCVBUF, soRcvbufForce, cfg.readBuffer, cfg.forceBuffers); err != nil {
+			return err
+		}
+	}
+
+	if cfg.writeBuffer > 0 {
+		if err := setBufferSize(fd, "SO_SNDBUF", syscall.SO_SNDBUF, soSndbufForce, cfg.writeBuffer, cfg.forceBuffers); err != nil {
+			return err
+		}
+	}
+
+	if cfg.hasDSCP {
+		if err := setDSCP(fd, family, cfg.dscp); err != nil {
+			return err
+		}
+	}
+
+	if cfg.mark != 0 {
+		if err := setPrivilegedOption(fd, "SO_MARK", syscall.SOL_SOCKET, syscall.SO_MARK, int(cfg.mark)); err != nil {
+			return err
+		}
+	}
+
+	if cfg.hasPriority {
+		if err := setPrivilegedOption(fd, "SO_PRIORITY", syscall.SOL_SOCKET, syscall.SO_PRIORITY, cfg.priority); err != nil {
+			return err
+		}
+	}
+
+	if cfg.busyPoll != nil {
+		if err := setBusyPoll(fd, cfg.busyPoll); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setPrivilegedOption sets an option that may need CAP_NET_ADMIN and says so
+// in the error if the process lacks it.
+func setPrivilegedOption(fd int, name string, level, opt, value int) error {
+	err := syscall.SetsockoptInt(fd, level, opt, value)
+	if err == syscall.EPERM {
+		return sockoptError(name, fmt.Errorf("%w (CAP_NET_ADMIN is required)", err))
+	}
+	if err != nil {
+		return sockoptError(name, err)
+	}
+	return nil
+}
+
+// setBusyPoll applies bp. Raising SO_BUSY_POLL above net.core.busy_read
+// needs CAP_NET_ADMIN, so a refusal names the sysctl value in the error.
+func setBusyPoll(fd int, bp *BusyPoll) error {
+	if bp.Timeout > 0 {
+		usec := int(bp.Timeout / time.Microsecond)
+
+		err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soBusyPoll, usec)
+		if err == syscall.EPERM {
+			busyRead, _ := readSysctlInt("net/core/busy_read")
+			return sockoptError("SO_BUSY_POLL", fmt.Errorf("%d usec exceeds net.core.busy_read (%d usec): %w (CAP_NET_ADMIN is required)",
+				usec, busyRead, err))
+		}
+		if err == syscall.ENOPROTOOPT {
+			return sockoptError("SO_BUSY_POLL", fmt.Errorf("%w (kernel built without CONFIG_NET_RX_BUSY_POLL)", err))
+		}
+		if err != nil {
+			return sockoptError("SO_BUSY_POLL", err)
+		}
+	}
+
+	if bp.Prefer {
+		if err := setPrivilegedOption(fd, "SO_PREFER_BUSY_POLL", syscall.SOL_SOCKET, soPreferBusyPoll, 1); err != nil {
+			return err
+		}
+	}
+
+	if bp.Budget > 0 {
+		if err := setPrivilegedOption(fd, "SO_BUSY_POLL_BUDGET", syscall.SOL_SOCKET, soBusyPollBudget, bp.Budget); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setMaxPacingRate sets SO_MAX_PACING_RATE, which takes a u64 since Linux
+// 4.20 and a u32 before.
+func setMaxPacingRate(fd int, rate uint64) error {
+	if rate <= math.MaxUint32 {
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soMaxPacingRate, int(rate))
+	}
+
+	b := make([]byte, 8)
+	nativeEndian.PutUint64(b, rate)
+	return syscall.SetsockoptString(fd, syscall.SOL_SOCKET, soMaxPacingRate, string(b))
+}
@@ -9,16 +9,12 @@
 package reuseport
 
 import (
-	"errors"
 	"net"
 	"os"
 	"syscall"
 )
 
-var (
-	listenerBacklogMaxSize    = maxListenerBacklog()
-	errUnsupportedTCPProtocol = errors.New("only tcp, tcp4, tcp6 are supported")
-)
+var listenerBacklogMaxSize = maxListenerBacklog()
 
 func getTCPSockaddr(proto, addr string) (sa syscall.Sockaddr, soType int, err error) {
 	var tcp *net.TCPAddr
@@ -67,7 +63,7 @@ func getTCPSockaddr(proto, addr string) (sa syscall.Sockaddr, soType int, err er
 		return sa, syscall.AF_INET6, nil
 	}
 
-	return nil, -1, errUnsupportedProtocol
+	return nil, -1, net.UnknownNetworkError(proto)
 }
 
 func determineTCPProto(proto string, ip *net.TCPAddr) (string, error) {
@@ -88,60 +84,83 @@ func determineTCPProto(proto string, ip *net.TCPAddr) (string, error) {
 		return proto, nil
 	}
 
-	return "", errUnsupportedTCPProtocol
+	return "", net.UnknownNetworkError(proto)
 }
 
 // NewReusablePortListener returns net.FileListener that created from
-// a file discriptor for a socket with SO_REUSEPORT option.
-func NewReusablePortListener(proto, addr string) (l net.Listener, err error) {
+// a file discriptor for a socket with SO_REUSEPORT option. Additional
+// socket options may be passed in opts.
+func NewReusablePortListener(proto, addr string, opts ...Option) (l net.Listener, err error) {
 	var (
 		soType, fd int
 		file       *os.File
 		sockaddr   syscall.Sockaddr
+		cfg        = newConfig(opts)
+		bindAddr   string
 	)
 
-	if sockaddr, soType, err = getSockaddr(proto, addr); err != nil {
-		return nil, err
+	if bindAddr, err = resolveDevice(addr, cfg); err != nil {
+		return nil, opError("", proto, addr, nil, err)
+	}
+
+	if sockaddr, soType, err = getSockaddr(proto, bindAddr); err != nil {
+		return nil, opError("", proto, addr, nil, err)
 	}
 
 	syscall.ForkLock.RLock()
 	if fd, err = syscall.Socket(soType, syscall.SOCK_STREAM, syscall.IPPROTO_TCP); err != nil {
 		syscall.ForkLock.RUnlock()
 
-		return nil, err
+		return nil, opError("socket", proto, addr, sockaddr, err)
 	}
 	syscall.ForkLock.RUnlock()
 
 	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
 		syscall.Close(fd)
-		return nil, err
+		return nil, opError("setsockopt:SO_REUSEADDR", proto, addr, sockaddr, err)
 	}
 
 	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, reusePort, 1); err != nil {
 		syscall.Close(fd)
-		return nil, err
+		return nil, opError("setsockopt:SO_REUSEPORT", proto, addr, sockaddr, err)
+	}
+
+	if err = setListenerOptions(fd, soType, cfg); err != nil {
+		syscall.Close(fd)
+		return nil, opError("setsockopt", proto, addr, sockaddr, err)
 	}
 
 	if err = syscall.Bind(fd, sockaddr); err != nil {
 		syscall.Close(fd)
-		return nil, err
+		return nil, opError("bind", proto, addr, sockaddr, bindError(proto, bindAddr, cfg.device, err))
 	}
 
 	// Set backlog size to the maximum
 	if err = syscall.Listen(fd, listenerBacklogMaxSize); err != nil {
 		syscall.Close(fd)
-		return nil, err
+		return nil, opError("listen", proto, addr, sockaddr, err)
 	}
 
-	file = os.NewFile(uintptr(fd), getSocketFileName(proto, addr))
+	if err = setListeningOptions(fd, cfg); err != nil {
+		syscall.Close(fd)
+		return nil, opError("setsockopt", proto, addr, sockaddr, err)
+	}
+
+	file = os.NewFile(uintptr(fd), socketFileName(fd, proto, addr))
 	if l, err = net.FileListener(file); err != nil {
 		file.Close()
-		return nil, err
+		return nil, opError("fileconn", proto, addr, sockaddr, err)
 	}
 
 	if err = file.Close(); err != nil {
-		return nil, err
+		l.Close()
+		return nil, opError("fileconn", proto, addr, sockaddr, err)
+	}
+
+	if err = guardGroup(l.(syscall.Conn), l.Addr(), cfg); err != nil {
+		l.Close()
+		return nil, opError("groupcheck", proto, addr, sockaddr, err)
 	}
 
-	return l, err
+	return wrapListener(l, cfg), nil
 }
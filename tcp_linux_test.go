@@ -0,0 +1,1168 @@
+// +build linux
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestReadTimestamp(t *testing.T) {
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10086", WithTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	before := time.Now()
+
+	if _, err = client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 16)
+	n, ts, err := ReadTimestamp(conn, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "ping" {
+		t.Errorf("Expected %q, got %q.", "ping", b[:n])
+	}
+	if ts.Before(before.Add(-time.Second)) || ts.After(time.Now()) {
+		t.Errorf("Expected receive timestamp around %v, got %v.", before, ts)
+	}
+}
+
+func TestListenerRejectsPacketConnOptions(t *testing.T) {
+	if _, err := NewReusablePortListener("tcp4", "127.0.0.1:10086", WithECN()); !errors.Is(err, errPacketConnOption) {
+		t.Errorf("Expected %v, got %v.", errPacketConnOption, err)
+	}
+}
+
+// dialFastOpen connects to addr with a TCP Fast Open SYN carrying data.
+func dialFastOpen(t *testing.T, addr *net.TCPAddr, data []byte) int {
+	t.Helper()
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sa := &syscall.SockaddrInet4{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To4())
+
+	const msgFastOpen = 0x20000000
+	if err = syscall.Sendto(fd, data, msgFastOpen, sa); err != nil {
+		syscall.Close(fd)
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestFastOpen(t *testing.T) {
+	key, err := ParseFastOpenKey("01234567-89abcdef-01234567-89abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10088", WithFastOpen(16), WithFastOpenKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if v := getsockoptInt(t, listener.(syscall.Conn), syscall.IPPROTO_TCP, tcpFastOpen); v != 16 {
+		t.Errorf("Expected TCP_FASTOPEN 16, got %d.", v)
+	}
+
+	// Both the client and the server bits of net.ipv4.tcp_fastopen are
+	// needed for the handshake below.
+	if b, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_fastopen"); err != nil {
+		t.Skip(err)
+	} else if v, _ := strconv.Atoi(strings.TrimSpace(string(b))); v&3 != 3 {
+		t.Skip("TCP Fast Open is disabled by net.ipv4.tcp_fastopen")
+	}
+
+	// The first connection fetches a cookie, unless the kernel still has
+	// one cached from an earlier run, and the second one uses it. Both
+	// deliver the data sent along with the SYN.
+	for i := 0; i < 2; i++ {
+		fd := dialFastOpen(t, listener.Addr().(*net.TCPAddr), []byte("ping"))
+		defer syscall.Close(fd)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 4)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "ping" {
+			t.Fatalf("Connection %d: expected to read %q, got %q (%v).", i, "ping", buf[:n], err)
+		}
+
+		opened, err := FastOpened(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && !opened {
+			t.Error("Expected the second connection to be opened with TCP Fast Open.")
+		}
+	}
+}
+
+func TestDeferAccept(t *testing.T) {
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10089", WithDeferAccept(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// The handshake is complete, but no data has been sent yet.
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(200 * time.Millisecond))
+	if conn, err := listener.Accept(); err == nil {
+		conn.Close()
+		t.Fatal("Expected Accept to wait for data on an idle connection.")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal(err)
+	}
+
+	if _, err = client.Write([]byte("GET / HTTP/1.0\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if conn.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Errorf("Expected connection from %v, got %v.", client.LocalAddr(), conn.RemoteAddr())
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	ka := KeepAlive{Idle: 30 * time.Second, Interval: 5 * time.Second, Count: 3}
+
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10090", WithKeepAlive(ka), WithUserTimeout(10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Conns accepted through AcceptTCP get the policy as well.
+	client2, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	tcpConn, err := listener.(interface{ AcceptTCP() (*net.TCPConn, error) }).AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+
+	for _, c := range []syscall.Conn{listener.(*optionListener).TCPListener, conn.(syscall.Conn), tcpConn} {
+		for _, opt := range []struct {
+			level, name, expected int
+		}{
+			{syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1},
+			{syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, 30},
+			{syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, 5},
+			{syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, 3},
+			{syscall.IPPROTO_TCP, tcpUserTimeout, 10000},
+		} {
+			if v := getsockoptInt(t, c, opt.level, opt.name); v != opt.expected {
+				t.Errorf("Expected option %d to be %d, got %d.", opt.name, opt.expected, v)
+			}
+		}
+	}
+}
+
+func TestKeepAliveKernelDefaults(t *testing.T) {
+	sysctl := func(name string) int {
+		b, err := ioutil.ReadFile("/proc/sys/net/ipv4/" + name)
+		if err != nil {
+			t.Skip(err)
+		}
+		v, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+		return v
+	}
+	interval, count := sysctl("tcp_keepalive_intvl"), sysctl("tcp_keepalive_probes")
+
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10090", WithKeepAlive(KeepAlive{Idle: 30 * time.Second}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The net package would leave the conn with a 15s interval.
+	if v := getsockoptInt(t, conn.(syscall.Conn), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL); v != interval {
+		t.Errorf("Expected the kernel keepalive interval %d, got %d.", interval, v)
+	}
+	if v := getsockoptInt(t, conn.(syscall.Conn), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT); v != count {
+		t.Errorf("Expected the kernel keepalive count %d, got %d.", count, v)
+	}
+
+	for _, opt := range []Option{
+		WithKeepAlive(KeepAlive{Idle: -time.Second}),
+		WithUserTimeout(-time.Second),
+		WithDeferAccept(-time.Second),
+	} {
+		if _, err = NewReusablePortListener("tcp4", "127.0.0.1:10090", opt); err == nil {
+			t.Error("Expected a negative setting to be rejected.")
+		}
+	}
+
+	// TCP_KEEPCNT is capped at 127.
+	_, err = NewReusablePortListener("tcp4", "127.0.0.1:10090", WithKeepAlive(KeepAlive{Count: 1000}))
+	var reuseErr *Error
+	if !errors.As(err, &reuseErr) || reuseErr.Op != "setsockopt:TCP_KEEPCNT" || reuseErr.Addr != "127.0.0.1:10090" {
+		t.Errorf("Expected a setsockopt:TCP_KEEPCNT *Error, got %v.", err)
+	}
+	if !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Expected EINVAL, got %v.", err)
+	}
+}
+
+func TestCongestionControl(t *testing.T) {
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10091", WithCongestionControl("reno"), WithMaxPacingRate(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var name string
+	if err = control(conn.(syscall.Conn), func(fd int) error {
+		b := make([]byte, 16)
+		n, err := getsockopt(fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, b)
+		name = strings.TrimRight(string(b[:n]), "\x00")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if name != "reno" {
+		t.Errorf("Expected congestion control %q, got %q.", "reno", name)
+	}
+
+	if v := getsockoptInt(t, conn.(syscall.Conn), syscall.SOL_SOCKET, soMaxPacingRate); v != 1<<20 {
+		t.Errorf("Expected SO_MAX_PACING_RATE %d, got %d.", 1<<20, v)
+	}
+
+	_, err = NewReusablePortListener("tcp4", "127.0.0.1:10091", WithCongestionControl("no-such-algorithm"))
+	if err == nil || !strings.Contains(err.Error(), "no-such-algorithm") {
+		t.Errorf("Expected an error naming the algorithm, got %v.", err)
+	}
+}
+
+func TestListenerDSCP(t *testing.T) {
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10094", WithDSCP(46))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, c := range []syscall.Conn{listener.(syscall.Conn), conn.(syscall.Conn)} {
+		if v := getsockoptInt(t, c, syscall.IPPROTO_IP, syscall.IP_TOS); v != 46<<2 {
+			t.Errorf("Expected IP_TOS %#x, got %#x.", 46<<2, v)
+		}
+	}
+
+	if _, err = NewReusablePortListener("tcp4", "127.0.0.1:10094", WithDSCP(64)); !errors.Is(err, errInvalidDSCP) {
+		t.Errorf("Expected %v, got %v.", errInvalidDSCP, err)
+	}
+}
+
+func TestMarkAndPriority(t *testing.T) {
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10096", WithMark(0x2a), WithPriority(4))
+	if os.Geteuid() != 0 {
+		if err == nil {
+			listener.Close()
+			t.Skip("SO_MARK was allowed without root")
+		}
+		if !errors.Is(err, syscall.EPERM) || !strings.Contains(err.Error(), "SO_MARK") {
+			t.Errorf("Expected a permission error naming SO_MARK, got %v.", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if v := getsockoptInt(t, conn.(syscall.Conn), syscall.SOL_SOCKET, syscall.SO_MARK); v != 0x2a {
+		t.Errorf("Expected SO_MARK %#x, got %#x.", 0x2a, v)
+	}
+	if v := getsockoptInt(t, listener.(syscall.Conn), syscall.SOL_SOCKET, syscall.SO_PRIORITY); v != 4 {
+		t.Errorf("Expected SO_PRIORITY %d, got %d.", 4, v)
+	}
+}
+
+func getsockoptDevice(t *testing.T, c syscall.Conn) string {
+	t.Helper()
+
+	var device string
+	if err := control(c, func(fd int) error {
+		b := make([]byte, syscall.IFNAMSIZ)
+		n, err := getsockopt(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, b)
+		device = strings.TrimRight(string(b[:n]), "\x00")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return device
+}
+
+func TestBindToDevice(t *testing.T) {
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1%lo:10097")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if device := getsockoptDevice(t, listener.(syscall.Conn)); device != "lo" {
+		t.Errorf("Expected listener bound to %q, got %q.", "lo", device)
+	}
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	siblings, err := Siblings("tcp4", "127.0.0.1:10097")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(siblings) != 1 || siblings[0].IfIndex != lo.Index {
+		t.Errorf("Expected a sibling bound to interface %d, got %+v.", lo.Index, siblings)
+	}
+
+	client, err := net.Dial("tcp4", "127.0.0.1:10097")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	packetConn, err := NewReusablePortPacketConn("udp4", "127.0.0.1:10097", WithDevice("lo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+
+	if device := getsockoptDevice(t, packetConn.(syscall.Conn)); device != "lo" {
+		t.Errorf("Expected packet conn bound to %q, got %q.", "lo", device)
+	}
+
+	if _, err = NewReusablePortListener("tcp4", "127.0.0.1:10097", WithDevice("no-such-dev0")); !errors.Is(err, syscall.ENODEV) {
+		t.Errorf("Expected %v, got %v.", syscall.ENODEV, err)
+	}
+
+	if _, err = NewReusablePortListener("tcp4", "127.0.0.1%lo:10097", WithDevice("eth0")); err == nil {
+		t.Error("Expected an error for conflicting devices.")
+	}
+}
+
+func TestFreebindAndTransparent(t *testing.T) {
+	// 192.0.2.0/24 is reserved for documentation and not configured here.
+	if _, err := NewReusablePortListener("tcp4", "192.0.2.1:10099"); !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		t.Fatalf("Expected %v, got %v.", syscall.EADDRNOTAVAIL, err)
+	}
+
+	listener, err := NewReusablePortListener("tcp4", "192.0.2.1:10099", WithFreebind())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	listener, err = NewReusablePortListener("tcp6", "[::1]:10099", WithTransparent())
+	if os.Geteuid() != 0 {
+		if !errors.Is(err, syscall.EPERM) || !strings.Contains(err.Error(), "IPV6_TRANSPARENT") {
+			t.Errorf("Expected a permission error naming IPV6_TRANSPARENT, got %v.", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if v := getsockoptInt(t, listener.(syscall.Conn), syscall.IPPROTO_IPV6, ipv6Transparent); v != 1 {
+		t.Errorf("Expected IPV6_TRANSPARENT to be set, got %d.", v)
+	}
+}
+
+func TestLingerReset(t *testing.T) {
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10100", WithLinger(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var l syscall.Linger
+	if err = control(conn.(syscall.Conn), func(fd int) error {
+		_, err := getsockopt(fd, syscall.SOL_SOCKET, syscall.SO_LINGER,
+			(*[unsafe.Sizeof(l)]byte)(unsafe.Pointer(&l))[:])
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if l.Onoff != 1 || l.Linger != 0 {
+		t.Errorf("Expected SO_LINGER {1 0}, got %+v.", l)
+	}
+
+	conn.Close()
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = client.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Expected %v, got %v.", syscall.ECONNRESET, err)
+	}
+}
+
+func TestZeroCopyConn(t *testing.T) {
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10102", WithZeroCopy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	zc, ok := conn.(*ZeroCopyConn)
+	if !ok {
+		t.Fatalf("Expected *ZeroCopyConn, got %T.", conn)
+	}
+
+	payload := make([]byte, 1<<20)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	received := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(client)
+		received <- b
+	}()
+
+	for i := 0; i < 4; i++ {
+		if n, err := zc.Write(payload); err != nil || n != len(payload) {
+			t.Fatalf("Expected to write %d bytes, wrote %d: %v.", len(payload), n, err)
+		}
+	}
+	if _, err = zc.Write([]byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	zc.CloseWrite()
+
+	b := <-received
+	if len(b) != 4*len(payload)+4 || string(b[len(b)-4:]) != "tail" || b[12345] != payload[12345] {
+		t.Errorf("Expected %d bytes ending in %q, got %d.", 4*len(payload)+4, "tail", len(b))
+	}
+
+	if zc.ZeroCopy() {
+		if zc.sent == 0 || zc.completed != zc.sent {
+			t.Errorf("Expected all zerocopy sends to complete, got %d of %d.", zc.completed, zc.sent)
+		}
+		// Loopback always falls back to copying.
+		if zc.Copied() == 0 {
+			t.Error("Expected loopback sends to be reported as copied.")
+		}
+	}
+}
+
+func TestTCPInfo(t *testing.T) {
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10103")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	for i := 0; i < 3; i++ {
+		client, err := net.Dial("tcp4", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+
+	var length, max int
+	for i := 0; i < 50; i++ {
+		if length, max, err = AcceptQueue(listener); err != nil {
+			t.Fatal(err)
+		}
+		if length == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if length != 3 || max != listenerBacklogMaxSize {
+		t.Errorf("Expected accept queue 3/%d, got %d/%d.", listenerBacklogMaxSize, length, max)
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := TCPInfo(conn.(syscall.Conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.State != tcpEstablished {
+		t.Errorf("Expected state %d, got %d.", tcpEstablished, stats.State)
+	}
+	if stats.RTT <= 0 || stats.SndCwnd == 0 || stats.SndMSS == 0 {
+		t.Errorf("Expected RTT, cwnd and MSS to be set, got %+v.", stats)
+	}
+}
+
+func TestSiblings(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := NewReusablePortListener("tcp4", "127.0.0.1:10104")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		listeners = append(listeners, l)
+	}
+
+	client, err := net.Dial("tcp4", "127.0.0.1:10104")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	siblings, err := Siblings("tcp", "127.0.0.1:10104")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(siblings) != len(listeners) {
+		t.Fatalf("Expected %d siblings, got %+v.", len(listeners), siblings)
+	}
+
+	var queued uint32
+	for _, s := range siblings {
+		if s.State != tcpListen || s.Addr.String() != "127.0.0.1:10104" {
+			t.Errorf("Expected a listener on 127.0.0.1:10104, got %+v.", s)
+		}
+		if !s.ReusePort || !s.ReusePortKnown {
+			t.Errorf("Expected SO_REUSEPORT to be known and set, got %+v.", s)
+		}
+		if len(s.Processes) != 1 || s.Processes[0].PID != os.Getpid() || s.Processes[0].Command == "" {
+			t.Errorf("Expected the socket to belong to this process, got %+v.", s.Processes)
+		}
+		if s.Inode == 0 || s.Cookie == 0 || s.SendQ != uint32(listenerBacklogMaxSize) {
+			t.Errorf("Expected inode, cookie and backlog to be set, got %+v.", s)
+		}
+		queued += s.RecvQ
+	}
+	if queued != 1 {
+		t.Errorf("Expected one queued connection, got %d.", queued)
+	}
+}
+
+func TestResolveSiblingsDevices(t *testing.T) {
+	// Inodes no process holds, so only the address and device tell.
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10097}
+	for _, tc := range []struct {
+		ifIndex   [2]int
+		reusePort bool
+	}{
+		{[2]int{0, 0}, true},
+		{[2]int{1, 0}, true},
+		{[2]int{1, 1}, true},
+		{[2]int{1, 2}, false},
+	} {
+		siblings := []Sibling{
+			{Addr: addr, State: tcpListen, Inode: 1 << 40, IfIndex: tc.ifIndex[0]},
+			{Addr: addr, State: tcpListen, Inode: 1<<40 + 1, IfIndex: tc.ifIndex[1]},
+		}
+		if err := resolveSiblings(siblings); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range siblings {
+			if s.ReusePortKnown != tc.reusePort || s.ReusePort != tc.reusePort {
+				t.Errorf("Devices %v: expected SO_REUSEPORT known %v, got %v (%v).", tc.ifIndex, tc.reusePort, s.ReusePortKnown, s.ReusePort)
+			}
+		}
+	}
+}
+
+func TestAddrInUseError(t *testing.T) {
+	plain, err := net.Listen("tcp4", "127.0.0.1:10105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+
+	_, err = NewReusablePortListener("tcp4", "127.0.0.1:10105")
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("Expected EADDRINUSE, got %v.", err)
+	}
+
+	var inUse *AddrInUseError
+	if !errors.As(err, &inUse) {
+		t.Fatalf("Expected an AddrInUseError, got %T.", err)
+	}
+	if len(inUse.Conflicts) != 1 {
+		t.Fatalf("Expected one conflict, got %+v.", inUse.Conflicts)
+	}
+
+	c := inUse.Conflicts[0]
+	if !c.NoReusePort || c.OtherUID {
+		t.Errorf("Expected a conflict without SO_REUSEPORT of the same user, got %+v.", c)
+	}
+	if len(c.Processes) != 1 || c.Processes[0].PID != os.Getpid() {
+		t.Errorf("Expected the conflict to belong to this process, got %+v.", c.Processes)
+	}
+	if !strings.Contains(err.Error(), "without SO_REUSEPORT") {
+		t.Errorf("Expected the error to name the missing SO_REUSEPORT, got %q.", err)
+	}
+}
+
+// TestHelperHoldAddr is not a real test. TestAddrInUseErrorOtherProcess
+// runs it in a child process to hold an address without SO_REUSEPORT.
+func TestHelperHoldAddr(t *testing.T) {
+	mode := os.Getenv("REUSEPORT_TEST_HOLD")
+	if mode == "" {
+		return
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Bind(fd, &syscall.SockaddrInet4{Port: 10109, Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if mode == "listen" {
+		if err = syscall.Listen(fd, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fmt.Println("ready")
+	ioutil.ReadAll(os.Stdin)
+	os.Exit(0)
+}
+
+func TestAddrInUseErrorOtherProcess(t *testing.T) {
+	for _, mode := range []string{"listen", "bind"} {
+		t.Run(mode, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestHelperHoldAddr$")
+			cmd.Env = append(os.Environ(), "REUSEPORT_TEST_HOLD="+mode)
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer cmd.Wait()
+			defer stdin.Close()
+
+			line := make([]byte, len("ready\n"))
+			if _, err = io.ReadFull(stdout, line); err != nil || string(line) != "ready\n" {
+				t.Fatalf("Expected the helper to be ready, got %q (%v).", line, err)
+			}
+
+			_, err = NewReusablePortListener("tcp4", "127.0.0.1:10109")
+			var inUse *AddrInUseError
+			if !errors.As(err, &inUse) {
+				t.Fatalf("Expected an AddrInUseError, got %v.", err)
+			}
+			if len(inUse.Conflicts) == 0 && mode == "bind" {
+				t.Skip("The kernel does not report bound-only sockets.")
+			}
+			if len(inUse.Conflicts) != 1 {
+				t.Fatalf("Expected one conflict, got %+v.", inUse.Conflicts)
+			}
+
+			c := inUse.Conflicts[0]
+			if len(c.Processes) != 1 || c.Processes[0].PID != cmd.Process.Pid {
+				t.Errorf("Expected the conflict to belong to the helper %d, got %+v.", cmd.Process.Pid, c.Processes)
+			}
+			if !c.NoReusePort || c.OtherUID {
+				t.Errorf("Expected a conflict without SO_REUSEPORT of the same user, got %+v.", c)
+			}
+			if !strings.Contains(err.Error(), "without SO_REUSEPORT") {
+				t.Errorf("Expected the error to name the missing SO_REUSEPORT, got %q.", err)
+			}
+		})
+	}
+}
+
+func TestExclusiveGroup(t *testing.T) {
+	intruders := make(chan []Sibling, 1)
+
+	var own uint64
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10106", WithExclusiveGroup(ExclusiveGroup{
+		// Only the first socket seen, our own, is expected.
+		Allow: func(s Sibling) bool {
+			if own == 0 {
+				own = s.Inode
+			}
+			return s.Inode == own
+		},
+		Interval: 10 * time.Millisecond,
+		OnIntruder: func(addr net.Addr, s []Sibling) {
+			select {
+			case intruders <- s:
+			default:
+			}
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	intruder, err := NewReusablePortListener("tcp4", "127.0.0.1:10106")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer intruder.Close()
+
+	select {
+	case s := <-intruders:
+		if len(s) != 1 || s[0].Inode == own {
+			t.Errorf("Expected the second listener as the only intruder, got %+v.", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the intruder to be reported.")
+	}
+
+	// Later checks only report sockets they have not reported yet.
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case s := <-intruders:
+		t.Errorf("Expected the intruder to be reported once, got %+v again.", s)
+	default:
+	}
+
+	second, err := NewReusablePortListener("tcp4", "127.0.0.1:10106")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	secondID, err := Identity(second.(syscall.Conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case s := <-intruders:
+		if len(s) != 1 || s[0].Cookie != secondID.Cookie {
+			t.Errorf("Expected the third listener as the only new intruder, got %+v.", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the new intruder to be reported.")
+	}
+
+	_, err = NewReusablePortListener("tcp4", "127.0.0.1:10106", WithExclusiveGroup(ExclusiveGroup{
+		Allow: func(s Sibling) bool { return s.Inode != own },
+	}))
+	var groupErr *GroupIntruderError
+	if !errors.As(err, &groupErr) {
+		t.Fatalf("Expected a GroupIntruderError, got %v.", err)
+	}
+	if len(groupErr.Intruders) != 1 || groupErr.Intruders[0].Inode != own {
+		t.Errorf("Expected the first listener as the only intruder, got %+v.", groupErr.Intruders)
+	}
+
+	// By default, sockets of this process are expected.
+	guarded, err := NewReusablePortListener("tcp4", "127.0.0.1:10106", WithExclusiveGroup(ExclusiveGroup{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	guarded.Close()
+}
+
+func TestListenThenDrop(t *testing.T) {
+	if os.Getenv("REUSEPORT_TEST_DROP") == "1" {
+		testListenThenDrop(t)
+		return
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("Binding privileged ports requires root.")
+	}
+
+	for _, ids := range [][2]int{{0, 0}, {0, 65534}, {65534, 0}} {
+		if _, _, err := ListenThenDrop(nil, ids[0], ids[1]); err != errDropToRoot {
+			t.Errorf("Expected %v for uid %d and gid %d, got %v.", errDropToRoot, ids[0], ids[1], err)
+		}
+	}
+
+	// Dropping privileges cannot be undone, so it happens in a child.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestListenThenDrop$", "-test.v")
+	cmd.Env = append(os.Environ(), "REUSEPORT_TEST_DROP=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+}
+
+func testListenThenDrop(t *testing.T) {
+	const nobody = 65534
+
+	listeners, conns, err := ListenThenDrop([]ListenSpec{
+		{Net: "tcp4", Addr: "127.0.0.1:107"},
+		{Net: "udp4", Addr: "127.0.0.1:107"},
+	}, nobody, nobody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || len(conns) != 1 {
+		t.Fatalf("Expected a listener and a packet conn, got %d and %d.", len(listeners), len(conns))
+	}
+	defer listeners[0].Close()
+	defer conns[0].Close()
+
+	if os.Getuid() != nobody || os.Getegid() != nobody {
+		t.Errorf("Expected uid and gid %d, got %d and %d.", nobody, os.Getuid(), os.Getegid())
+	}
+
+	client, err := net.Dial("tcp4", "127.0.0.1:107")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	if _, err = NewReusablePortListener("tcp4", "127.0.0.1:108"); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("Expected EACCES for a privileged port, got %v.", err)
+	}
+}
+
+// newNetns creates a network namespace and returns a path to it, or skips
+// the test without the privileges to do so.
+func newNetns(t *testing.T) string {
+	t.Helper()
+
+	type result struct {
+		ns  *os.File
+		err error
+	}
+	done := make(chan result)
+
+	go func() {
+		// The thread is left locked, so that it ends with the goroutine
+		// rather than going back to the runtime in the new namespace.
+		runtime.LockOSThread()
+
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			done <- result{err: err}
+			return
+		}
+
+		ns, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+		done <- result{ns, err}
+	}()
+
+	r := <-done
+	if errors.Is(r.err, syscall.EPERM) {
+		t.Skip("Creating a network namespace requires CAP_SYS_ADMIN.")
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	t.Cleanup(func() { r.ns.Close() })
+
+	return fmt.Sprintf("/proc/self/fd/%d", r.ns.Fd())
+}
+
+func TestListenInNetns(t *testing.T) {
+	ns := newNetns(t)
+
+	listener, err := ListenInNetns(ns, "tcp4", "0.0.0.0:10107")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, err := ListenPacketInNetns(ns, "udp4", "0.0.0.0:10107")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The host namespace does not see them, so plain sockets can still
+	// take the port here.
+	hostListener, err := net.Listen("tcp4", "127.0.0.1:10107")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hostListener.Close()
+
+	hostConn, err := net.ListenPacket("udp4", "127.0.0.1:10107")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hostConn.Close()
+
+	if _, err = ListenInNetns("/nonexistent", "tcp4", "0.0.0.0:10107"); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing namespace to fail, got %v.", err)
+	}
+}
+
+func TestExclusiveGroupError(t *testing.T) {
+	ns, err := os.Open(newNetns(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+
+	errs := make(chan error, 1)
+	listener, err := ListenInNetns(fmt.Sprintf("/proc/self/fd/%d", ns.Fd()), "tcp4", "0.0.0.0:10111", WithExclusiveGroup(ExclusiveGroup{
+		Interval: 10 * time.Millisecond,
+		OnError: func(addr net.Addr, err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// The periodic checks can no longer join the namespace.
+	ns.Close()
+
+	select {
+	case err := <-errs:
+		var reuseErr *Error
+		if !errors.As(err, &reuseErr) || reuseErr.Op != "groupcheck" {
+			t.Errorf("Expected a groupcheck *Error, got %v.", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the failed check to be reported.")
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10108")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	id, err := Identity(listener.(syscall.Conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Net != "tcp4" || id.Addr != "127.0.0.1:10108" || id.Cookie == 0 || id.Inode == 0 {
+		t.Errorf("Expected a tcp4 127.0.0.1:10108 identity with cookie and inode, got %+v.", id)
+	}
+
+	siblings, err := Siblings("tcp4", "127.0.0.1:10108")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(siblings) != 1 || siblings[0].Cookie != id.Cookie || siblings[0].Inode != id.Inode {
+		t.Errorf("Expected sock_diag to report cookie %d and inode %d, got %+v.", id.Cookie, id.Inode, siblings)
+	}
+
+	conn, err := NewReusablePortPacketConn("udp6", "[::1]:10108")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	connID, err := Identity(conn.(syscall.Conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connID.Net != "udp6" || connID.Addr != "[::1]:10108" || connID.Cookie == id.Cookie {
+		t.Errorf("Expected a distinct udp6 [::1]:10108 identity, got %+v.", connID)
+	}
+}
+
+func TestInheritedListener(t *testing.T) {
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10110")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	id, err := Identity(listener.(syscall.Conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The listener's own fd has close-on-exec set, so it is not taken.
+	if _, err = InheritedListener(id); err != ErrNotInherited {
+		t.Fatalf("Expected %v, got %v.", ErrNotInherited, err)
+	}
+
+	// dup leaves close-on-exec clear, as on an fd passed across exec.
+	for _, match := range []SocketID{id, {Net: "tcp", Addr: "127.0.0.1:10110"}} {
+		var fd int
+		if err = control(listener.(syscall.Conn), func(lfd int) (err error) {
+			fd, err = syscall.Dup(lfd)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		inherited, err := InheritedListener(match)
+		if err != nil {
+			syscall.Close(fd)
+			t.Fatal(err)
+		}
+
+		if _, err := syscall.Getsockname(fd); err != syscall.EBADF {
+			t.Errorf("Expected the inherited fd to be closed, got %v.", err)
+		}
+
+		inheritedID, err := Identity(inherited.(syscall.Conn))
+		inherited.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inheritedID.Cookie != id.Cookie {
+			t.Errorf("Expected %+v to match %+v.", match, id)
+		}
+	}
+
+	if _, err = InheritedPacketConn(SocketID{Net: "udp4", Addr: "127.0.0.1:10110"}); err != ErrNotInherited {
+		t.Errorf("Expected %v, got %v.", ErrNotInherited, err)
+	}
+}
+
+func TestPacketConnRejectsListenerOptions(t *testing.T) {
+	if _, err := NewReusablePortPacketConn("udp4", "127.0.0.1:10088", WithFastOpen(16)); !errors.Is(err, errListenerOption) {
+		t.Errorf("Expected %v, got %v.", errListenerOption, err)
+	}
+}
@@ -9,12 +9,16 @@
 package reuseport
 
 import (
+	"errors"
 	"fmt"
 	"html"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -189,6 +193,89 @@ func TestNewReusablePortServers(t *testing.T) {
 	httpServerOne.Close()
 }
 
+func TestListenerBufferSizes(t *testing.T) {
+	// Stay below the stock limits, such as 208 KiB for net.core.rmem_max
+	// and net.core.wmem_max on Linux.
+	listener, err := NewReusablePortListener("tcp4", "127.0.0.1:10092", WithReadBuffer(64<<10), WithWriteBuffer(32<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	read, write, err := BufferSizes(listener.(syscall.Conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != 64<<10*bufferOverhead {
+		t.Errorf("Expected read buffer %d, got %d.", 64<<10*bufferOverhead, read)
+	}
+	if write != 32<<10*bufferOverhead {
+		t.Errorf("Expected write buffer %d, got %d.", 32<<10*bufferOverhead, write)
+	}
+}
+
+func TestListenerErrors(t *testing.T) {
+	_, err := NewReusablePortListener("unix", "/tmp/reuseport.sock")
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "listen" || opErr.Net != "unix" {
+		t.Fatalf("Expected a listen *net.OpError, got %#v.", err)
+	}
+	if _, ok := opErr.Err.(net.UnknownNetworkError); !ok {
+		t.Errorf("Expected an UnknownNetworkError, got %#v.", opErr.Err)
+	}
+
+	_, err = NewReusablePortListener("tcp4", "192.0.2.1:10081")
+	var reuseErr *Error
+	if !errors.As(err, &reuseErr) {
+		t.Fatalf("Expected an *Error, got %#v.", err)
+	}
+	if reuseErr.Op != "bind" || reuseErr.Net != "tcp4" || reuseErr.Addr != "192.0.2.1:10081" {
+		t.Errorf("Expected bind tcp4 192.0.2.1:10081, got %s %s %s.", reuseErr.Op, reuseErr.Net, reuseErr.Addr)
+	}
+	if !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		t.Errorf("Expected EADDRNOTAVAIL, got %v.", err)
+	}
+	if want := "listen tcp4 192.0.2.1:10081: bind: "; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("Expected the error to start with %q, got %q.", want, err)
+	}
+}
+
+func TestSplitDevice(t *testing.T) {
+	for _, tc := range []struct{ in, addr, device string }{
+		{"127.0.0.1%lo:80", "127.0.0.1:80", "lo"},
+		{"10.0.0.1%vrf-blue:443", "10.0.0.1:443", "vrf-blue"},
+		{"127.0.0.1:80", "127.0.0.1:80", ""},
+		{"[fe80::1%eth0]:80", "[fe80::1%eth0]:80", ""},
+		{":80", ":80", ""},
+	} {
+		addr, device := splitDevice(tc.in)
+		if addr != tc.addr || device != tc.device {
+			t.Errorf("%q: expected %q and %q, got %q and %q.", tc.in, tc.addr, tc.device, addr, device)
+		}
+	}
+}
+
+func TestParseFastOpenKey(t *testing.T) {
+	const s = "00112233-44556677-8899aabb-ccddeeff"
+
+	key, err := ParseFastOpenKey(s + ",ffeeddcc-bbaa9988-77665544-33221100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.String() != s {
+		t.Errorf("Expected %s, got %s.", s, key)
+	}
+	if key[0] != 0x33 || key[3] != 0x00 {
+		t.Errorf("Expected little-endian groups, got %x.", key[:])
+	}
+
+	for _, bad := range []string{"", "0011-2233", "00112233-44556677-8899aabb-xxxxxxxx", "00112233-44556677-8899aabb-ccddeeff00"} {
+		if _, err = ParseFastOpenKey(bad); err != errInvalidFastOpenKey {
+			t.Errorf("%q: expected %v, got %v.", bad, errInvalidFastOpenKey, err)
+		}
+	}
+}
+
 func BenchmarkNewReusablePortListener(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		listener, err := NewReusablePortListener("tcp", ":10081")
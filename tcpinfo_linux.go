@@ -0,0 +1,159 @@
+// +build linux
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// rawTCPInfo mirrors the head of struct tcp_info from linux/tcp.h, up to
+// tcpi_delivery_rate. Kernels older than 4.9 fill in less of it.
+type rawTCPInfo struct {
+	State       uint8
+	CAState     uint8
+	Retransmits uint8
+	Probes      uint8
+	Backoff     uint8
+	Options     uint8
+	Wscale      uint8
+	Flags       uint8
+
+	RTO    uint32
+	ATO    uint32
+	SndMSS uint32
+	RcvMSS uint32
+
+	Unacked uint32
+	Sacked  uint32
+	Lost    uint32
+	Retrans uint32
+	Fackets uint32
+
+	LastDataSent uint32
+	LastAckSent  uint32
+	LastDataRecv uint32
+	LastAckRecv  uint32
+
+	PMTU        uint32
+	RcvSsthresh uint32
+	RTT         uint32
+	RTTVar      uint32
+	SndSsthresh uint32
+	SndCwnd     uint32
+	AdvMSS      uint32
+	Reordering  uint32
+
+	RcvRTT   uint32
+	RcvSpace uint32
+
+	TotalRetrans uint32
+
+	PacingRate    uint64
+	MaxPacingRate uint64
+	BytesAcked    uint64
+	BytesReceived uint64
+	SegsOut       uint32
+	SegsIn        uint32
+
+	NotsentBytes uint32
+	MinRTT       uint32
+	DataSegsIn   uint32
+	DataSegsOut  uint32
+
+	DeliveryRate uint64
+}
+
+// TCPStats is the decoded tcp_info of a TCP socket, as returned by TCPInfo.
+type TCPStats struct {
+	State       uint8 // TCP_ESTABLISHED, TCP_LISTEN, ... from linux/tcp_states.h
+	Retransmits uint8 // retransmits of the current unacked segment
+	Options     uint8 // TCPI_OPT_* flags
+
+	RTT    time.Duration // smoothed round-trip time
+	RTTVar time.Duration // round-trip time variance
+	MinRTT time.Duration // minimum observed round-trip time
+	RTO    time.Duration // retransmission timeout
+
+	SndMSS       uint32
+	RcvMSS       uint32
+	SndCwnd      uint32 // congestion window, in segments
+	SndSsthresh  uint32 // slow start threshold, in segments
+	Unacked      uint32 // segments in flight; accept queue length for listeners
+	Sacked       uint32 // SACKed segments; accept queue limit for listeners
+	Lost         uint32
+	Retrans      uint32 // retransmitted segments in flight
+	TotalRetrans uint32 // retransmitted segments over the connection lifetime
+
+	PacingRate    uint64 // bytes per second
+	DeliveryRate  uint64 // bytes per second
+	BytesAcked    uint64
+	BytesReceived uint64
+}
+
+// TCPInfo returns the decoded tcp_info (TCP_INFO) of c, which may be a conn
+// accepted from a listener created by NewReusablePortListener or the
+// listener itself. See also AcceptQueue.
+func TCPInfo(c syscall.Conn) (*TCPStats, error) {
+	var info rawTCPInfo
+	if err := control(c, func(fd int) error {
+		return getTCPInfo(fd, &info)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &TCPStats{
+		State:         info.State,
+		Retransmits:   info.Retransmits,
+		Options:       info.Options,
+		RTT:           time.Duration(info.RTT) * time.Microsecond,
+		RTTVar:        time.Duration(info.RTTVar) * time.Microsecond,
+		MinRTT:        time.Duration(info.MinRTT) * time.Microsecond,
+		RTO:           time.Duration(info.RTO) * time.Microsecond,
+		SndMSS:        info.SndMSS,
+		RcvMSS:        info.RcvMSS,
+		SndCwnd:       info.SndCwnd,
+		SndSsthresh:   info.SndSsthresh,
+		Unacked:       info.Unacked,
+		Sacked:        info.Sacked,
+		Lost:          info.Lost,
+		Retrans:       info.Retrans,
+		TotalRetrans:  info.TotalRetrans,
+		PacingRate:    info.PacingRate,
+		DeliveryRate:  info.DeliveryRate,
+		BytesAcked:    info.BytesAcked,
+		BytesReceived: info.BytesReceived,
+	}, nil
+}
+
+// AcceptQueue returns the number of connections waiting in the accept
+// queue of a listener created by NewReusablePortListener, and the size
+// limit of that queue. Comparing it across a reuseport group shows which
+// process is falling behind.
+func AcceptQueue(l net.Listener) (length, max int, err error) {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return 0, 0, syscall.EINVAL
+	}
+
+	stats, err := TCPInfo(sc)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(stats.Unacked), int(stats.Sacked), nil
+}
+
+func getTCPInfo(fd int, info *rawTCPInfo) error {
+	_, err := getsockopt(fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+		(*[unsafe.Sizeof(rawTCPInfo{})]byte)(unsafe.Pointer(info))[:])
+	return err
+}
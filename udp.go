@@ -9,14 +9,11 @@
 package reuseport
 
 import (
-	"errors"
 	"net"
 	"os"
 	"syscall"
 )
 
-var errUnsupportedUDPProtocol = errors.New("only udp, udp4, udp6 are supported")
-
 func getUDPSockaddr(proto, addr string) (sa syscall.Sockaddr, soType int, err error) {
 	var udp *net.UDPAddr
 
@@ -64,7 +61,7 @@ func getUDPSockaddr(proto, addr string) (sa syscall.Sockaddr, soType int, err er
 		return sa, syscall.AF_INET6, nil
 	}
 
-	return nil, -1, errUnsupportedProtocol
+	return nil, -1, net.UnknownNetworkError(proto)
 }
 
 func determineUDPProto(proto string, ip *net.UDPAddr) (string, error) {
@@ -85,20 +82,27 @@ func determineUDPProto(proto string, ip *net.UDPAddr) (string, error) {
 		return proto, nil
 	}
 
-	return "", errUnsupportedUDPProtocol
+	return "", net.UnknownNetworkError(proto)
 }
 
 // NewReusablePortPacketConn returns net.FilePacketConn that created from
-// a file discriptor for a socket with SO_REUSEPORT option.
-func NewReusablePortPacketConn(proto, addr string) (l net.PacketConn, err error) {
+// a file discriptor for a socket with SO_REUSEPORT option. Additional
+// socket options may be passed in opts.
+func NewReusablePortPacketConn(proto, addr string, opts ...Option) (l net.PacketConn, err error) {
 	var (
 		soType, fd int
 		file       *os.File
 		sockaddr   syscall.Sockaddr
+		cfg        = newConfig(opts)
+		bindAddr   string
 	)
 
-	if sockaddr, soType, err = getSockaddr(proto, addr); err != nil {
-		return nil, err
+	if bindAddr, err = resolveDevice(addr, cfg); err != nil {
+		return nil, opError("", proto, addr, nil, err)
+	}
+
+	if sockaddr, soType, err = getSockaddr(proto, bindAddr); err != nil {
+		return nil, opError("", proto, addr, nil, err)
 	}
 
 	syscall.ForkLock.RLock()
@@ -109,7 +113,7 @@ func NewReusablePortPacketConn(proto, addr string) (l net.PacketConn, err error)
 	syscall.ForkLock.RUnlock()
 	if err != nil {
 		syscall.Close(fd)
-		return nil, err
+		return nil, opError("socket", proto, addr, sockaddr, err)
 	}
 
 	defer func() {
@@ -119,29 +123,55 @@ func NewReusablePortPacketConn(proto, addr string) (l net.PacketConn, err error)
 	}()
 
 	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
-		return nil, err
+		return nil, opError("setsockopt:SO_REUSEADDR", proto, addr, sockaddr, err)
 	}
 
 	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, reusePort, 1); err != nil {
-		return nil, err
+		return nil, opError("setsockopt:SO_REUSEPORT", proto, addr, sockaddr, err)
 	}
 
 	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
-		return nil, err
+		return nil, opError("setsockopt:SO_BROADCAST", proto, addr, sockaddr, err)
+	}
+
+	if err = setPacketConnOptions(fd, soType, cfg); err != nil {
+		return nil, opError("setsockopt", proto, addr, sockaddr, err)
 	}
 
 	if err = syscall.Bind(fd, sockaddr); err != nil {
-		return nil, err
+		return nil, opError("bind", proto, addr, sockaddr, bindError(proto, bindAddr, cfg.device, err))
 	}
 
-	file = os.NewFile(uintptr(fd), getSocketFileName(proto, addr))
+	file = os.NewFile(uintptr(fd), socketFileName(fd, proto, addr))
 	if l, err = net.FilePacketConn(file); err != nil {
-		return nil, err
+		return nil, opError("fileconn", proto, addr, sockaddr, err)
 	}
 
 	if err = file.Close(); err != nil {
-		return nil, err
+		return nil, opError("fileconn", proto, addr, sockaddr, err)
+	}
+	fd = -1 // closed along with file; l holds a duplicate
+
+	if err = guardGroup(l.(syscall.Conn), l.LocalAddr(), cfg); err != nil {
+		l.Close()
+		return nil, opError("groupcheck", proto, addr, sockaddr, err)
 	}
 
 	return l, err
 }
+
+func sockaddrToUDPAddr(sa syscall.Sockaddr) *net.UDPAddr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.UDPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		addr := &net.UDPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port}
+		if sa.ZoneId != 0 {
+			if iface, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				addr.Zone = iface.Name
+			}
+		}
+		return addr
+	}
+	return nil
+}
@@ -0,0 +1,598 @@
+// +build linux
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func getsockoptInt(t *testing.T, c syscall.Conn, level, opt int) int {
+	t.Helper()
+
+	var v int
+	if err := control(c, func(fd int) (err error) {
+		v, err = syscall.GetsockoptInt(fd, level, opt)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestWithPathMTUDiscovery(t *testing.T) {
+	c, err := NewReusablePortPacketConn("udp4", "127.0.0.1:10083", WithPathMTUDiscovery(PMTUDDo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if v := getsockoptInt(t, c.(syscall.Conn), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER); v != syscall.IP_PMTUDISC_DO {
+		t.Errorf("Expected IP_MTU_DISCOVER %d, got %d.", syscall.IP_PMTUDISC_DO, v)
+	}
+	if v := getsockoptInt(t, c.(syscall.Conn), syscall.IPPROTO_IP, syscall.IP_RECVERR); v != 1 {
+		t.Errorf("Expected IP_RECVERR to be set, got %d.", v)
+	}
+
+	c6, err := NewReusablePortPacketConn("udp6", "[::1]:10083", WithPathMTUDiscovery(PMTUDProbe))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c6.Close()
+
+	if v := getsockoptInt(t, c6.(syscall.Conn), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER); v != syscall.IPV6_PMTUDISC_PROBE {
+		t.Errorf("Expected IPV6_MTU_DISCOVER %d, got %d.", syscall.IPV6_PMTUDISC_PROBE, v)
+	}
+
+	// A dual-stack socket needs both, for its IPv4 and IPv6 peers.
+	dual, err := NewReusablePortPacketConn("udp6", "[::]:10083", WithPathMTUDiscovery(PMTUDDo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dual.Close()
+
+	if v := getsockoptInt(t, dual.(syscall.Conn), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER); v != syscall.IPV6_PMTUDISC_DO {
+		t.Errorf("Expected IPV6_MTU_DISCOVER %d, got %d.", syscall.IPV6_PMTUDISC_DO, v)
+	}
+	if v := getsockoptInt(t, dual.(syscall.Conn), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER); v != syscall.IP_PMTUDISC_DO {
+		t.Errorf("Expected IP_MTU_DISCOVER %d on a dual-stack socket, got %d.", syscall.IP_PMTUDISC_DO, v)
+	}
+
+	if _, err = NewReusablePortPacketConn("udp4", "127.0.0.1:10083", WithPathMTUDiscovery(PMTUDMode(42))); !errors.Is(err, errUnsupportedPMTUDMode) {
+		t.Errorf("Expected %v, got %v.", errUnsupportedPMTUDMode, err)
+	}
+}
+
+func TestPathMTU(t *testing.T) {
+	server, err := NewReusablePortPacketConn("udp4", "127.0.0.1:10083", WithPathMTUDiscovery(PMTUDDo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	mtu, err := PathMTU(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu <= 0 {
+		t.Errorf("Expected positive path MTU, got %d.", mtu)
+	}
+
+	if err = ReadPathMTUError(server.(syscall.Conn)); err != nil {
+		t.Errorf("Expected empty error queue, got %v.", err)
+	}
+}
+
+func TestExtendedErrorPathMTUError(t *testing.T) {
+	router := net.IPv4(192, 0, 2, 1)
+	e := ExtendedError{Errno: syscall.EMSGSIZE, Origin: ErrOriginICMP, Info: 1280, Offender: router}
+	if mtuErr := e.PathMTUError(); mtuErr == nil || mtuErr.MTU != 1280 || !mtuErr.From.Equal(router) {
+		t.Errorf("Expected a path MTU of 1280 reported by %s, got %v.", router, mtuErr)
+	}
+
+	e = ExtendedError{Errno: syscall.EMSGSIZE, Origin: ErrOriginLocal, Info: 1500}
+	if mtuErr := e.PathMTUError(); mtuErr == nil || mtuErr.MTU != 1500 || mtuErr.From != nil {
+		t.Errorf("Expected a local path MTU of 1500, got %v.", mtuErr)
+	}
+
+	e = ExtendedError{Errno: syscall.ECONNREFUSED, Origin: ErrOriginICMP}
+	if mtuErr := e.PathMTUError(); mtuErr != nil {
+		t.Errorf("Expected no path MTU error, got %v.", mtuErr)
+	}
+}
+
+func TestReadErrQueue(t *testing.T) {
+	// A dual-stack socket queues the errors of its IPv4 peers as well. It
+	// gets a port of its own, since errors go to the most specific socket
+	// bound to the source address.
+	for _, tc := range []struct{ proto, addr string }{
+		{"udp4", "127.0.0.1:10083"},
+		{"udp6", "[::]:10112"},
+	} {
+
+		c, err := NewReusablePortPacketConn(tc.proto, tc.addr, WithExtendedErrors())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		// Grab a free port and release it, so nobody is listening there.
+		closed, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := closed.LocalAddr()
+		closed.Close()
+
+		if _, err = c.WriteTo([]byte("ping"), dst); err != nil {
+			t.Fatal(err)
+		}
+
+		var errs []ExtendedError
+		for i := 0; i < 50 && len(errs) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+
+			if errs, err = ReadErrQueue(c.(syscall.Conn)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if len(errs) != 1 {
+			t.Fatalf("%s: expected 1 error queue record, got %d.", tc.proto, len(errs))
+		}
+
+		e := errs[0]
+		if !errors.Is(&e, syscall.ECONNREFUSED) {
+			t.Errorf("%s: expected %v, got %v.", tc.proto, syscall.ECONNREFUSED, e.Errno)
+		}
+		if e.Origin != ErrOriginICMP || e.Type != 3 || e.Code != 3 {
+			t.Errorf("%s: expected ICMP port unreachable, got %v.", tc.proto, &e)
+		}
+		if !e.Offender.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("%s: expected offender 127.0.0.1, got %v.", tc.proto, e.Offender)
+		}
+		if e.Addr.String() != dst.String() {
+			t.Errorf("%s: expected address %v, got %v.", tc.proto, dst, e.Addr)
+		}
+	}
+}
+
+func TestReadWriteMsgECN(t *testing.T) {
+	for _, tc := range []struct{ proto, addr, client string }{
+		{"udp4", "127.0.0.1:10084", "127.0.0.1:0"},
+		{"udp6", "[::1]:10084", "[::1]:0"},
+	} {
+		server, err := NewReusablePortPacketConn(tc.proto, tc.addr, WithECN())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+
+		client, err := NewReusablePortPacketConn(tc.proto, tc.client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		for _, ecn := range []ECN{ECNNotECT, ECNECT0, ECNECT1, ECNCE} {
+			if _, err = WriteMsg(client, []byte("ping"), &ControlMessage{ECN: ecn}, server.LocalAddr().(*net.UDPAddr)); err != nil {
+				t.Fatal(err)
+			}
+
+			b := make([]byte, 16)
+			n, cm, addr, err := ReadMsg(server, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b[:n]) != "ping" {
+				t.Errorf("Expected %q, got %q.", "ping", b[:n])
+			}
+			if addr.Port != client.LocalAddr().(*net.UDPAddr).Port {
+				t.Errorf("Expected sender %v, got %v.", client.LocalAddr(), addr)
+			}
+			if cm.ECN != ecn {
+				t.Errorf("%s: expected %v, got %v.", tc.proto, ecn, cm.ECN)
+			}
+		}
+
+		// A connected socket sends to its peer without an address.
+		connected, err := net.DialUDP(tc.proto, nil, server.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer connected.Close()
+
+		if _, err = WriteMsg(connected, []byte("ping"), &ControlMessage{ECN: ECNECT0}, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		_, cm, _, err := ReadMsg(server, make([]byte, 16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cm.ECN != ECNECT0 {
+			t.Errorf("%s connected: expected %v, got %v.", tc.proto, ECNECT0, cm.ECN)
+		}
+	}
+}
+
+func TestWriteMsgDSCP(t *testing.T) {
+	for _, tc := range []struct{ proto, addr, client string }{
+		{"udp4", "127.0.0.1:10095", "127.0.0.1:0"},
+		{"udp6", "[::1]:10095", "[::1]:0"},
+	} {
+		server, err := NewReusablePortPacketConn(tc.proto, tc.addr, WithECN())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+
+		client, err := NewReusablePortPacketConn(tc.proto, tc.client, WithDSCP(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		dst := server.LocalAddr().(*net.UDPAddr)
+		for _, c := range []struct {
+			cm   *ControlMessage
+			dscp uint8
+			ecn  ECN
+		}{
+			{nil, 10, ECNNotECT},
+			{&ControlMessage{ECN: ECNECT0}, 10, ECNECT0},
+			{&ControlMessage{DSCP: 46, HasDSCP: true, ECN: ECNECT1}, 46, ECNECT1},
+			{&ControlMessage{HasDSCP: true, ECN: ECNCE}, 0, ECNCE},
+			{&ControlMessage{ECN: ECNECT0}, 10, ECNECT0},
+		} {
+			if _, err = WriteMsg(client, []byte("ping"), c.cm, dst); err != nil {
+				t.Fatal(err)
+			}
+
+			_, cm, _, err := ReadMsg(server, make([]byte, 16))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cm.DSCP != c.dscp || cm.ECN != c.ecn {
+				t.Errorf("%s: expected DSCP %d with %v, got %d with %v.", tc.proto, c.dscp, c.ecn, cm.DSCP, cm.ECN)
+			}
+		}
+
+		// A later change to the socket DSCP applies to the next datagram.
+		family := syscall.AF_INET
+		if tc.proto == "udp6" {
+			family = syscall.AF_INET6
+		}
+		if err = control(client.(syscall.Conn), func(fd int) error {
+			return setDSCP(fd, family, 20)
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = WriteMsg(client, []byte("ping"), &ControlMessage{ECN: ECNECT0}, dst); err != nil {
+			t.Fatal(err)
+		}
+		_, cm, _, err := ReadMsg(server, make([]byte, 16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cm.DSCP != 20 || cm.ECN != ECNECT0 {
+			t.Errorf("%s: expected DSCP 20 with %v, got %d with %v.", tc.proto, ECNECT0, cm.DSCP, cm.ECN)
+		}
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	server, err := NewReusablePortPacketConn("udp4", "127.0.0.1:10085", WithTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewReusablePortPacketConn("udp4", "127.0.0.1:0", WithTxTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	before := time.Now()
+
+	if _, err = client.WriteTo([]byte("ping"), server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, cm, _, err := ReadMsg(server, make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Timestamp.Before(before.Add(-time.Second)) || cm.Timestamp.After(time.Now()) {
+		t.Errorf("Expected receive timestamp around %v, got %v.", before, cm.Timestamp)
+	}
+
+	errs, err := ReadErrQueue(client.(syscall.Conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 || errs[0].Origin != ErrOriginTimestamping {
+		t.Fatalf("Expected 1 transmit timestamp, got %v.", errs)
+	}
+	if errs[0].Timestamp.Before(before.Add(-time.Second)) || errs[0].Timestamp.After(time.Now()) {
+		t.Errorf("Expected transmit timestamp around %v, got %v.", before, errs[0].Timestamp)
+	}
+
+	// Receive timestamps alone leave nothing on the error queue.
+	if _, err = server.WriteTo([]byte("pong"), client.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if errs, err = ReadErrQueue(server.(syscall.Conn)); err != nil || len(errs) != 0 {
+		t.Errorf("Expected an empty error queue, got %v (%v).", errs, err)
+	}
+}
+
+func TestCountDrops(t *testing.T) {
+	server, err := NewReusablePortPacketConn("udp4", "127.0.0.1:10087", WithDropCounter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// Shrink the receive buffer to the minimum so that a burst overflows it.
+	if err = control(server.(syscall.Conn), func(fd int) error {
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 1)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := CountDrops(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	payload := make([]byte, 1024)
+	for i := 0; i < 64; i++ {
+		if _, err = client.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Drain what made it into the queue; the drops are reported on the
+	// first datagram queued after them.
+	b := make([]byte, len(payload))
+	for {
+		c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, _, err = c.ReadFrom(b); err != nil {
+			break
+		}
+	}
+
+	if _, err = client.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err = c.ReadFrom(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Drops() == 0 {
+		t.Error("Expected a non-zero drop count.")
+	}
+
+	other, err := NewReusablePortPacketConn("udp4", "127.0.0.1:10087", WithDropCounter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	o, err := CountDrops(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total := (DropCountingGroup{c, o}).Drops(); total != uint64(c.Drops()) {
+		t.Errorf("Expected group drop count %d, got %d.", c.Drops(), total)
+	}
+}
+
+func TestBufferSizeError(t *testing.T) {
+	b, err := ioutil.ReadFile("/proc/sys/net/core/rmem_max")
+	if err != nil {
+		t.Skip(err)
+	}
+	rmemMax, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewReusablePortPacketConn("udp4", "127.0.0.1:10093", WithReadBuffer(rmemMax*2))
+
+	var bufErr *BufferSizeError
+	if !errors.As(err, &bufErr) {
+		t.Fatalf("Expected *BufferSizeError, got %v.", err)
+	}
+	if bufErr.Option != "SO_RCVBUF" || bufErr.Requested != rmemMax*2 || bufErr.Granted != rmemMax*2 {
+		t.Errorf("Expected SO_RCVBUF %d granted as %d, got %v.", rmemMax*2, rmemMax*2, bufErr)
+	}
+
+	c, err := NewReusablePortPacketConn("udp4", "127.0.0.1:10093", WithReadBuffer(rmemMax*2), WithForcedBuffers())
+	if errors.As(err, &bufErr) {
+		t.Skip("SO_RCVBUFFORCE needs CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if read, _, err := BufferSizes(c.(syscall.Conn)); err != nil {
+		t.Fatal(err)
+	} else if read != rmemMax*4 {
+		t.Errorf("Expected forced read buffer %d, got %d.", rmemMax*4, read)
+	}
+}
+
+func TestOriginalDestination(t *testing.T) {
+	for _, tc := range []struct{ proto, addr, dst string }{
+		{"udp4", "0.0.0.0:10098", "127.0.0.1:10098"},
+		{"udp6", "[::]:10098", "[::1]:10098"},
+	} {
+		server, err := NewReusablePortPacketConn(tc.proto, tc.addr, WithOriginalDestination())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+
+		client, err := net.Dial(tc.proto, tc.dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if _, err = client.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+
+		_, cm, _, err := ReadMsg(server, make([]byte, 16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cm.Dst == nil || cm.Dst.String() != tc.dst {
+			t.Errorf("Expected original destination %s, got %v.", tc.dst, cm.Dst)
+		}
+	}
+}
+
+func TestBusyPoll(t *testing.T) {
+	bp := BusyPoll{Timeout: 50 * time.Microsecond, Prefer: true, Budget: 16}
+
+	c, err := NewReusablePortPacketConn("udp4", "127.0.0.1:10101", WithBusyPoll(bp))
+	if errors.Is(err, syscall.ENOPROTOOPT) {
+		t.Skip(err)
+	}
+	if os.Geteuid() != 0 {
+		if err == nil {
+			c.Close()
+			t.Skip("busy polling was allowed without root")
+		}
+		if !errors.Is(err, syscall.EPERM) || !strings.Contains(err.Error(), "net.core.busy_read") {
+			t.Errorf("Expected a permission error naming net.core.busy_read, got %v.", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The kernel has no getter for SO_BUSY_POLL_BUDGET.
+	for _, opt := range []struct{ name, expected int }{
+		{soBusyPoll, 50},
+		{soPreferBusyPoll, 1},
+	} {
+		if v := getsockoptInt(t, c.(syscall.Conn), syscall.SOL_SOCKET, opt.name); v != opt.expected {
+			t.Errorf("Expected option %#x to be %d, got %d.", opt.name, opt.expected, v)
+		}
+	}
+}
+
+// BenchmarkBusyPollLatency compares the p99 round-trip latency of a UDP
+// ping-pong with and without busy polling on the receiving side.
+func BenchmarkBusyPollLatency(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"Normal", nil},
+		{"BusyPoll", []Option{WithBusyPoll(BusyPoll{Timeout: 50 * time.Microsecond})}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			server, err := NewReusablePortPacketConn("udp4", "127.0.0.1:0", bc.opts...)
+			if err != nil {
+				b.Skip(err)
+			}
+			defer server.Close()
+
+			client, err := NewReusablePortPacketConn("udp4", "127.0.0.1:0", bc.opts...)
+			if err != nil {
+				b.Skip(err)
+			}
+			defer client.Close()
+
+			go func() {
+				buf := make([]byte, 64)
+				for {
+					n, addr, err := server.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+					server.WriteTo(buf[:n], addr)
+				}
+			}()
+
+			latencies := make([]time.Duration, b.N)
+			buf := make([]byte, 64)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				if _, err = client.WriteTo(buf, server.LocalAddr()); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err = client.ReadFrom(buf); err != nil {
+					b.Fatal(err)
+				}
+				latencies[i] = time.Since(start)
+			}
+			b.StopTimer()
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+		})
+	}
+}
+
+func TestUDPSiblings(t *testing.T) {
+	c, err := NewReusablePortPacketConn("udp6", "[::]:10104")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	siblings, err := Siblings("udp", "127.0.0.1:10104")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(siblings) != 1 {
+		t.Fatalf("Expected the wildcard socket as the only sibling, got %+v.", siblings)
+	}
+
+	s := siblings[0]
+	if _, ok := s.Addr.(*net.UDPAddr); !ok || !s.ReusePort || len(s.Processes) != 1 {
+		t.Errorf("Expected a UDP socket with SO_REUSEPORT owned by this process, got %+v.", s)
+	}
+}
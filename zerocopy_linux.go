@@ -0,0 +1,170 @@
+// +build linux
+
+// Copyright (C) 2017 Max Riveiro
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package reuseport
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	soZeroCopy  = 0x3c      // SO_ZEROCOPY
+	msgZeroCopy = 0x4000000 // MSG_ZEROCOPY
+
+	// soEECodeZeroCopyCopied is set in ee_code when the kernel had to copy
+	// the data after all, e.g. on loopback.
+	soEECodeZeroCopyCopied = 1
+
+	// zeroCopyMinSize is the smallest write worth the page pinning and
+	// completion round trip of MSG_ZEROCOPY.
+	zeroCopyMinSize = 16 << 10
+)
+
+// ZeroCopyConn is a TCP conn that sends large writes with MSG_ZEROCOPY.
+// Write does not return before the kernel reports that it is done with the
+// buffer, so the caller may reuse it as with any io.Writer. On kernels
+// without SO_ZEROCOPY it falls back to regular copying writes.
+type ZeroCopyConn struct {
+	*net.TCPConn
+
+	copied uint64 // zerocopy sends the kernel copied anyway, atomic
+
+	enabled bool
+
+	// Only touched with the write lock of the conn held.
+	sent      uint32 // zerocopy sends issued
+	completed uint32 // zerocopy sends the kernel has released
+}
+
+// NewZeroCopyConn enables SO_ZEROCOPY on c, which must be a *net.TCPConn
+// such as one accepted from a listener created by NewReusablePortListener.
+func NewZeroCopyConn(c net.Conn) (*ZeroCopyConn, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, syscall.EINVAL
+	}
+
+	zc := &ZeroCopyConn{TCPConn: tc}
+
+	err := control(tc, func(fd int) error {
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soZeroCopy, 1)
+	})
+	switch err {
+	case nil:
+		zc.enabled = true
+	case syscall.ENOPROTOOPT, syscall.EOPNOTSUPP:
+		// Older than Linux 4.14: keep copying.
+	default:
+		return nil, err
+	}
+
+	return zc, nil
+}
+
+// ZeroCopy reports whether c sends with MSG_ZEROCOPY, as opposed to the
+// copying fallback.
+func (c *ZeroCopyConn) ZeroCopy() bool {
+	return c.enabled
+}
+
+// Copied returns how many MSG_ZEROCOPY sends the kernel completed by
+// copying the data instead, which it does e.g. on loopback.
+func (c *ZeroCopyConn) Copied() uint64 {
+	return atomic.LoadUint64(&c.copied)
+}
+
+// Write implements net.Conn. Writes of at least 16 KiB are sent with
+// MSG_ZEROCOPY, and Write waits for their completion notifications before
+// it returns. If Write fails, the kernel may still be reading from b.
+func (c *ZeroCopyConn) Write(b []byte) (int, error) {
+	if !c.enabled || len(b) < zeroCopyMinSize {
+		return c.TCPConn.Write(b)
+	}
+
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		n       int
+		sendErr error
+	)
+
+	err = rc.Write(func(fd uintptr) bool {
+		for n < len(b) {
+			var m int
+			m, sendErr = syscall.SendmsgN(int(fd), b[n:], nil, nil, msgZeroCopy)
+			if sendErr == syscall.EAGAIN {
+				return false
+			}
+			if sendErr == syscall.ENOBUFS {
+				// Out of optmem for the notification: copy instead.
+				m, sendErr = syscall.SendmsgN(int(fd), b[n:], nil, nil, 0)
+				if sendErr == syscall.EAGAIN {
+					return false
+				}
+			} else if sendErr == nil && m > 0 {
+				c.sent++
+			}
+			if sendErr != nil {
+				return true
+			}
+			n += m
+		}
+		return true
+	})
+	if err == nil {
+		err = sendErr
+	}
+	if err != nil {
+		return n, &net.OpError{Op: "write", Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+	}
+
+	if err = c.waitCompletions(rc); err != nil {
+		return n, &net.OpError{Op: "write", Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+	}
+
+	return n, nil
+}
+
+// waitCompletions reads the error queue until every zerocopy send issued so
+// far has been released by the kernel. Error queue readiness is signalled
+// with EPOLLERR, which wakes up writers, so this waits as a writer and does
+// not get in the way of concurrent reads.
+func (c *ZeroCopyConn) waitCompletions(rc syscall.RawConn) error {
+	var readErr error
+
+	err := rc.Write(func(fd uintptr) bool {
+		for c.completed != c.sent {
+			var e *ExtendedError
+			if e, readErr = readErrQueue(int(fd), nil); readErr != nil {
+				return true
+			}
+			if e == nil {
+				return false
+			}
+			if e.Origin != ErrOriginZeroCopy {
+				continue
+			}
+
+			// Info and Data hold the inclusive range of completed sends.
+			c.completed += e.Data - e.Info + 1
+			if e.Code&soEECodeZeroCopyCopied != 0 {
+				atomic.AddUint64(&c.copied, uint64(e.Data-e.Info+1))
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = readErr
+	}
+	return err
+}